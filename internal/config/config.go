@@ -10,23 +10,128 @@ import (
 	"github.com/buglloc/deblocker/internal/services/dnssrv"
 )
 
+type DNSRateLimit struct {
+	QPS        float64                `yaml:"qps"`
+	Burst      int                    `yaml:"burst"`
+	IPv4Prefix int                    `yaml:"ipv4_prefix"`
+	IPv6Prefix int                    `yaml:"ipv6_prefix"`
+	Size       int64                  `yaml:"size"`
+	Action     dnssrv.RateLimitAction `yaml:"action"`
+}
+
 type DNSServer struct {
 	Addrs         []string      `yaml:"addrs"`
 	MaxTCPQueries int           `yaml:"max_tcp_queries"`
 	ReadTimeout   time.Duration `yaml:"read_timeout"`
 	WriteTimeout  time.Duration `yaml:"write_timeout"`
+	TLSCert       string        `yaml:"tls_cert"`
+	TLSKey        string        `yaml:"tls_key"`
+	TLSClientCA   string        `yaml:"tls_client_ca"`
+	AllowedNets   []string      `yaml:"allowed_nets"`
+	DeniedNets    []string      `yaml:"denied_nets"`
+	RateLimit     DNSRateLimit  `yaml:"rate_limit"`
+}
+
+type DNSRoute struct {
+	Domains           []string                `yaml:"domains"`
+	IncludeVPNDomains bool                    `yaml:"include_vpn_domains"`
+	Addrs             []string                `yaml:"addrs"`
+	Strategy          dnssrv.UpstreamStrategy `yaml:"strategy"`
+	Dev               string                  `yaml:"dev"`
+	Fwmark            uint32                  `yaml:"fwmark"`
+	LocalZone         bool                    `yaml:"local_zone"`
+}
+
+type DNSECS struct {
+	Mode         dnssrv.ECSMode `yaml:"mode"`
+	DirectSubnet string         `yaml:"direct_subnet"`
+	VPNSubnet    string         `yaml:"vpn_subnet"`
 }
 
 type DNSClient struct {
-	Addr         string        `yaml:"addr"`
-	DialTimeout  time.Duration `yaml:"dial_timeout"`
-	ReadTimeout  time.Duration `yaml:"read_timeout"`
-	WriteTimeout time.Duration `yaml:"write_timeout"`
+	Addr         string                  `yaml:"addr"`
+	Addrs        []string                `yaml:"addrs"`
+	Strategy     dnssrv.UpstreamStrategy `yaml:"strategy"`
+	Routes       []DNSRoute              `yaml:"routes"`
+	Dev          string                  `yaml:"dev"`
+	Fwmark       uint32                  `yaml:"fwmark"`
+	ECS          DNSECS                  `yaml:"ecs"`
+	DialTimeout  time.Duration           `yaml:"dial_timeout"`
+	ReadTimeout  time.Duration           `yaml:"read_timeout"`
+	WriteTimeout time.Duration           `yaml:"write_timeout"`
+}
+
+func (c DNSClient) Upstreams() []string {
+	if len(c.Addrs) > 0 {
+		return c.Addrs
+	}
+
+	return []string{c.Addr}
+}
+
+type DNSCache struct {
+	Size        int64         `yaml:"size"`
+	MinTTL      time.Duration `yaml:"min_ttl"`
+	MaxTTL      time.Duration `yaml:"max_ttl"`
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+	ServeStale  bool          `yaml:"serve_stale"`
+	StaleTTL    time.Duration `yaml:"stale_ttl"`
+}
+
+type DNSPrefetch struct {
+	Size    int `yaml:"size"`
+	MinHits int `yaml:"min_hits"`
+}
+
+type DNSLocalRecord struct {
+	Name  string `yaml:"name"`
+	Type  string `yaml:"type"`
+	Value string `yaml:"value"`
+}
+
+type DNSLocal struct {
+	Records      []DNSLocalRecord `yaml:"records"`
+	HostsFiles   []string         `yaml:"hosts_files"`
+	TTL          time.Duration    `yaml:"ttl"`
+	ReloadPeriod time.Duration    `yaml:"reload_period"`
+	Observable   bool             `yaml:"observable"`
+}
+
+type DNSQueryLogClient struct {
+	Nets       []string `yaml:"nets"`
+	SampleRate float64  `yaml:"sample_rate"`
+}
+
+type DNSQueryLog struct {
+	Path         string              `yaml:"path"`
+	MaxSizeMB    int64               `yaml:"max_size_mb"`
+	RotatePeriod time.Duration       `yaml:"rotate_period"`
+	MaxBackups   int                 `yaml:"max_backups"`
+	SampleRate   float64             `yaml:"sample_rate"`
+	Clients      []DNSQueryLogClient `yaml:"clients"`
+}
+
+type DNSSEC struct {
+	Validate     bool     `yaml:"validate"`
+	TrustAnchors []string `yaml:"trust_anchors"`
+}
+
+type DNSDoHBypass struct {
+	Enabled bool                   `yaml:"enabled"`
+	Canary  bool                   `yaml:"canary"`
+	Domains []string               `yaml:"domains"`
+	Action  dnssrv.DoHBypassAction `yaml:"action"`
 }
 
 type DNS struct {
 	Server          DNSServer       `yaml:"server"`
 	Client          DNSClient       `yaml:"client"`
+	Cache           DNSCache        `yaml:"cache"`
+	Prefetch        DNSPrefetch     `yaml:"prefetch"`
+	Local           DNSLocal        `yaml:"local"`
+	QueryLog        DNSQueryLog     `yaml:"query_log"`
+	DNSSEC          DNSSEC          `yaml:"dnssec"`
+	DoHBypass       DNSDoHBypass    `yaml:"doh_bypass"`
 	ObservableNets  []string        `yaml:"observable_nets"`
 	ObservableProto []dnssrv.IPKind `yaml:"observable_proto"`
 }
@@ -44,19 +149,22 @@ type BGP struct {
 }
 
 type Checker struct {
-	DirectDev     string        `yaml:"direct_dev"`
-	VPNDev        string        `yaml:"vpn_dev"`
-	Concurrency   int           `yaml:"concurrency"`
-	QueueSize     int           `yaml:"queue_size"`
-	IPHistorySize int64         `yaml:"ip_history_size"`
-	IPHistoryTTL  time.Duration `yaml:"ip_history_ttl"`
-	DecisionsSize int64         `yaml:"decisions_size"`
-	DecisionsTTL  time.Duration `yaml:"decisions_ttl"`
-	VPNSitesSize  int64         `yaml:"vpn_sites_size"`
-	VPNSitesTTL   time.Duration `yaml:"vpn_sites_ttl"`
-	RecheckPeriod time.Duration `yaml:"recheck_period"`
-	DirectDomains []string      `yaml:"direct_domains"`
-	VPNDomains    []string      `yaml:"vpn_domains"`
+	DirectDev        string        `yaml:"direct_dev"`
+	VPNDev           string        `yaml:"vpn_dev"`
+	Concurrency      int           `yaml:"concurrency"`
+	QueueSize        int           `yaml:"queue_size"`
+	IPHistorySize    int64         `yaml:"ip_history_size"`
+	IPHistoryTTL     time.Duration `yaml:"ip_history_ttl"`
+	DecisionsSize    int64         `yaml:"decisions_size"`
+	DecisionsTTL     time.Duration `yaml:"decisions_ttl"`
+	VPNSitesSize     int64         `yaml:"vpn_sites_size"`
+	VPNSitesTTL      time.Duration `yaml:"vpn_sites_ttl"`
+	RecheckPeriod    time.Duration `yaml:"recheck_period"`
+	DirectDomains    []string      `yaml:"direct_domains"`
+	VPNDomains       []string      `yaml:"vpn_domains"`
+	SyncCheckTimeout time.Duration `yaml:"sync_check_timeout"`
+	ISPResolver      string        `yaml:"isp_resolver"`
+	ISPStubNets      []string      `yaml:"isp_stub_nets"`
 }
 
 type Config struct {
@@ -78,6 +186,11 @@ func LoadConfig(configs ...string) (*Config, error) {
 				MaxTCPQueries: -1,
 				ReadTimeout:   2 * time.Second,
 				WriteTimeout:  2 * time.Second,
+				RateLimit: DNSRateLimit{
+					IPv4Prefix: 32,
+					IPv6Prefix: 56,
+					Size:       65536,
+				},
 			},
 			Client: DNSClient{
 				Addr:         "tcp://1.1.1.1:53",
@@ -85,6 +198,28 @@ func LoadConfig(configs ...string) (*Config, error) {
 				ReadTimeout:  2 * time.Second,
 				WriteTimeout: 2 * time.Second,
 			},
+			Cache: DNSCache{
+				Size:        8192,
+				MaxTTL:      1 * time.Hour,
+				NegativeTTL: 5 * time.Minute,
+				StaleTTL:    24 * time.Hour,
+			},
+			Prefetch: DNSPrefetch{
+				MinHits: 3,
+			},
+			Local: DNSLocal{
+				TTL:          5 * time.Minute,
+				ReloadPeriod: 10 * time.Second,
+			},
+			QueryLog: DNSQueryLog{
+				MaxSizeMB:    100,
+				RotatePeriod: 24 * time.Hour,
+				MaxBackups:   7,
+				SampleRate:   1,
+			},
+			DoHBypass: DNSDoHBypass{
+				Canary: true,
+			},
 			ObservableProto: []dnssrv.IPKind{
 				dnssrv.IPKindV4,
 			},
@@ -0,0 +1,85 @@
+package dnscheck
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/buglloc/deblocker/internal/netutil"
+)
+
+type CheckerConfig struct {
+	resolverAddr string
+	directDev    string
+	stubNets     []*net.IPNet
+	timeout      time.Duration
+	err          error
+}
+
+func NewCheckerConfig() *CheckerConfig {
+	return &CheckerConfig{
+		timeout: 2 * time.Second,
+	}
+}
+
+// WithResolver sets the in-country (e.g. ISP) resolver which answers are compared with the trusted ones
+func (c *CheckerConfig) WithResolver(addr string) *CheckerConfig {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	c.resolverAddr = addr
+	return c
+}
+
+func (c *CheckerConfig) WithDirectDev(dev string) *CheckerConfig {
+	c.directDev = dev
+	return c
+}
+
+// WithStubNets sets the nets of the known stub (block page) IPs
+func (c *CheckerConfig) WithStubNets(nets ...string) *CheckerConfig {
+	for _, cidr := range nets {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			c.err = multierror.Append(c.err, fmt.Errorf("invalid stub net %q: %w", cidr, err))
+			continue
+		}
+
+		c.stubNets = append(c.stubNets, ipnet)
+	}
+
+	return c
+}
+
+func (c *CheckerConfig) WithTimeout(timeout time.Duration) *CheckerConfig {
+	c.timeout = timeout
+	return c
+}
+
+func (c *CheckerConfig) Build() *CheckerConfig {
+	return c
+}
+
+func (c *CheckerConfig) Validate() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	if c.resolverAddr == "" {
+		return errors.New("resolver must be set")
+	}
+
+	if c.directDev == "" {
+		return errors.New("direct device must be set")
+	}
+
+	if err := netutil.CheckDev(c.directDev); err != nil {
+		return fmt.Errorf("invalid direct device: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package dnscheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+
+	"github.com/buglloc/deblocker/internal/netutil"
+	"github.com/buglloc/deblocker/internal/services/dnssrv"
+)
+
+var bogonNets = mustParseCIDRs(
+	// shared address space (RFC 6598)
+	"100.64.0.0/10",
+	// benchmarking (RFC 2544)
+	"198.18.0.0/15",
+	// reserved
+	"240.0.0.0/4",
+)
+
+// Checker detects DNS poisoning by comparing the in-country resolver answers (asked over the direct device)
+// with the ones of the trusted upstream
+type Checker struct {
+	cfg  *CheckerConfig
+	dnsc *dns.Client
+}
+
+func NewChecker(cfg *CheckerConfig) (*Checker, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &Checker{
+		cfg: cfg,
+		dnsc: &dns.Client{
+			Net:     "udp",
+			Timeout: cfg.timeout,
+			Dialer: &net.Dialer{
+				Timeout: cfg.timeout,
+				Control: netutil.BindToDeviceControl(cfg.directDev),
+			},
+		},
+	}, nil
+}
+
+// IsPoisoned reports whether the in-country resolver lies about the fqdn that the trusted upstream resolved to the ip:
+// NXDOMAIN or empty A answer injection, stub IPs or bogons instead of the public IP. Private or bogon trusted IPs
+// are never reported.
+// Just different public IPs are not the signal since CDNs answer depending on the resolver location.
+func (c *Checker) IsPoisoned(ctx context.Context, fqdn, ip string, ipKind dnssrv.IPKind) (bool, error) {
+	trustedIP := net.ParseIP(ip)
+	if trustedIP == nil {
+		return false, fmt.Errorf("invalid trusted IP: %s", ip)
+	}
+
+	// private names (e.g. of the split-horizon zones) are never resolved by the in-country resolver,
+	// so its NXDOMAIN or empty answer isn't the injection signal and there is no point to route them anyway
+	if isBogon(trustedIP) {
+		return false, nil
+	}
+
+	var qtype uint16
+	switch ipKind {
+	case dnssrv.IPKindV4:
+		qtype = dns.TypeA
+	case dnssrv.IPKindV6:
+		qtype = dns.TypeAAAA
+	default:
+		return false, fmt.Errorf("unsupported ip kind: %s", ipKind)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(fqdn), qtype)
+	rsp, _, err := c.dnsc.ExchangeContext(ctx, req, c.cfg.resolverAddr)
+	if err != nil {
+		return false, fmt.Errorf("unable to resolve %q: %w", fqdn, err)
+	}
+
+	switch rsp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unexpected rcode: %s", dns.RcodeToString[rsp.Rcode])
+	}
+
+	var ips []net.IP
+	for _, rr := range rsp.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			ips = append(ips, v.A)
+		case *dns.AAAA:
+			ips = append(ips, v.AAAA)
+		}
+	}
+
+	if len(ips) == 0 {
+		// plenty of in-country resolvers just have no IPv6 connectivity to the authoritative servers,
+		// so only the empty A answer is the injection signal
+		return ipKind == dnssrv.IPKindV4, nil
+	}
+
+	for _, answerIP := range ips {
+		if answerIP.Equal(trustedIP) {
+			return false, nil
+		}
+	}
+
+	for _, answerIP := range ips {
+		if containsIP(c.cfg.stubNets, answerIP) {
+			return true, nil
+		}
+
+		if isBogon(answerIP) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func isBogon(ip net.IP) bool {
+	return ip.IsUnspecified() ||
+		ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() ||
+		containsIP(bogonNets, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func mustParseCIDRs(nets ...string) []*net.IPNet {
+	out := make([]*net.IPNet, len(nets))
+	for i, cidr := range nets {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(fmt.Sprintf("invalid net %q: %v", cidr, err))
+		}
+
+		out[i] = ipnet
+	}
+
+	return out
+}
@@ -0,0 +1,79 @@
+package dnscheck
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/buglloc/deblocker/internal/services/dnssrv"
+)
+
+func TestIsPoisoned(t *testing.T) {
+	cases := []struct {
+		name      string
+		trustedIP string
+		rcode     int
+		answerIP  string
+		poisoned  bool
+	}{
+		{name: "same IP", trustedIP: "192.0.2.1", answerIP: "192.0.2.1"},
+		{name: "another public IP", trustedIP: "192.0.2.1", answerIP: "198.51.100.1"},
+		{name: "NXDOMAIN", trustedIP: "192.0.2.1", rcode: dns.RcodeNameError, poisoned: true},
+		{name: "empty A", trustedIP: "192.0.2.1", poisoned: true},
+		{name: "bogon instead of public IP", trustedIP: "192.0.2.1", answerIP: "100.64.0.1", poisoned: true},
+		{name: "NXDOMAIN of private name", trustedIP: "10.0.0.5", rcode: dns.RcodeNameError},
+		{name: "empty A of private name", trustedIP: "10.0.0.5"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Checker{
+				cfg: NewCheckerConfig().WithResolver(startTestResolver(t, tc.rcode, tc.answerIP)).Build(),
+				dnsc: &dns.Client{
+					Net:     "udp",
+					Timeout: time.Second,
+				},
+			}
+
+			poisoned, err := c.IsPoisoned(context.Background(), "example.corp", tc.trustedIP, dnssrv.IPKindV4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if poisoned != tc.poisoned {
+				t.Fatalf("poisoned: got %t, want %t", poisoned, tc.poisoned)
+			}
+		})
+	}
+}
+
+// startTestResolver starts the in-country resolver that answers any question with the rcode and the A record if any
+func startTestResolver(t *testing.T, rcode int, answerIP string) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			rsp := new(dns.Msg)
+			rsp.SetRcode(r, rcode)
+			if answerIP != "" {
+				rsp.Answer = append(rsp.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP(answerIP),
+				})
+			}
+			_ = w.WriteMsg(rsp)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = pc.Close() })
+
+	// queries are queued by the socket until the server starts serving it
+	return pc.LocalAddr().String()
+}
@@ -0,0 +1,45 @@
+package domains
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Normalize converts domains into the ".example.com." form that Contains and Match expect
+func Normalize(domains []string) []string {
+	out := make([]string, len(domains))
+	for i, domain := range domains {
+		d := strings.Trim(domain, ".")
+		out[i] = fmt.Sprintf(".%s.", d)
+	}
+	return out
+}
+
+// Contains reports whether fqdn is a subdomain of any of the normalized domains
+func Contains(domains []string, fqdn string) bool {
+	for _, d := range domains {
+		if fqdn == d || strings.HasSuffix(fqdn, d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match returns the length of the longest normalized domain that fqdn belongs to (including the domain itself)
+// or -1 if there is no such domain
+func Match(domains []string, fqdn string) int {
+	fqdn = strings.ToLower(fqdn)
+	best := -1
+	for _, d := range domains {
+		if len(d) <= best {
+			continue
+		}
+
+		if fqdn == d[1:] || strings.HasSuffix(fqdn, d) {
+			best = len(d)
+		}
+	}
+
+	return best
+}
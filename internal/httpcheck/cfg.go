@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"time"
+
+	"github.com/buglloc/deblocker/internal/netutil"
 )
 
 type CheckerConfig struct {
@@ -37,7 +39,7 @@ func (c *CheckerConfig) Validate() error {
 		return errors.New("VPM device must be set")
 	}
 
-	if err := checkDev(c.directDev); err != nil {
+	if err := netutil.CheckDev(c.directDev); err != nil {
 		return fmt.Errorf("invalid direct devive: %w", err)
 	}
 
@@ -45,7 +47,7 @@ func (c *CheckerConfig) Validate() error {
 		return errors.New("vpn device must be set")
 	}
 
-	if err := checkDev(c.vpnDev); err != nil {
+	if err := netutil.CheckDev(c.vpnDev); err != nil {
 		return fmt.Errorf("invalid vpn devive: %w", err)
 	}
 
@@ -0,0 +1,69 @@
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+)
+
+type ControlFn func(network, address string, c syscall.RawConn) error
+
+// DialControl returns the socket control function that binds sockets to the dev and marks them with the fwmark.
+// Returns nil if neither dev nor fwmark are set.
+func DialControl(dev string, fwmark uint32) ControlFn {
+	switch {
+	case dev == "" && fwmark == 0:
+		return nil
+	case fwmark == 0:
+		return BindToDeviceControl(dev)
+	case dev == "":
+		return FwmarkControl(fwmark)
+	}
+
+	bindToDev := BindToDeviceControl(dev)
+	setMark := FwmarkControl(fwmark)
+	return func(network, address string, c syscall.RawConn) error {
+		if err := bindToDev(network, address, c); err != nil {
+			return err
+		}
+
+		return setMark(network, address, c)
+	}
+}
+
+func BindToDeviceControl(dev string) ControlFn {
+	return func(network, address string, c syscall.RawConn) error {
+		var cerr error
+		err := c.Control(func(fd uintptr) {
+			cerr = syscall.BindToDevice(int(fd), dev)
+		})
+
+		if err != nil {
+			return fmt.Errorf("socket Control: %w", err)
+		}
+
+		if cerr != nil {
+			return fmt.Errorf("BindToDevice: %w", cerr)
+		}
+
+		return nil
+	}
+}
+
+func FwmarkControl(mark uint32) ControlFn {
+	return func(network, address string, c syscall.RawConn) error {
+		var cerr error
+		err := c.Control(func(fd uintptr) {
+			cerr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+		})
+
+		if err != nil {
+			return fmt.Errorf("socket Control: %w", err)
+		}
+
+		if cerr != nil {
+			return fmt.Errorf("SO_MARK: %w", cerr)
+		}
+
+		return nil
+	}
+}
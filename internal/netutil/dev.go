@@ -0,0 +1,27 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+)
+
+func CheckDev(dev string) error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("unable to list network interfaces: %w", err)
+	}
+
+	for _, iface := range ifaces {
+		if iface.Name != dev {
+			continue
+		}
+
+		if iface.Flags&net.FlagUp == 0 {
+			return fmt.Errorf("interface %q in not up", dev)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("interface with name %q is not found", dev)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 
 	bgpapi "github.com/osrg/gobgp/v3/api"
 	bgpsrv "github.com/osrg/gobgp/v3/pkg/server"
@@ -15,11 +16,12 @@ import (
 )
 
 type Server struct {
-	bgpSrv     *bgpsrv.BgpServer
-	cfg        *ServerConfig
-	closed     chan struct{}
-	ctx        context.Context
-	shutdownFn context.CancelFunc
+	bgpSrv       *bgpsrv.BgpServer
+	cfg          *ServerConfig
+	ipv6Exported atomic.Bool
+	closed       chan struct{}
+	ctx          context.Context
+	shutdownFn   context.CancelFunc
 }
 
 func NewServer(cfg *ServerConfig) (*Server, error) {
@@ -61,6 +63,18 @@ func (s *Server) ListenAndServe() error {
 		Str("addrs", strings.Join(s.cfg.addrs, ",")).
 		Msg("bgp server started")
 
+	// IPv6Exported is asked on every DNS answer, so it's recalculated on the peer state changes only
+	err = s.bgpSrv.WatchEvent(s.ctx, &bgpapi.WatchEventRequest{
+		Peer: &bgpapi.WatchEventRequest_Peer{},
+	}, func(rsp *bgpapi.WatchEventResponse) {
+		if rsp.GetPeer() != nil {
+			s.refreshIPv6Exported()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("unable to watch peer events: %w", err)
+	}
+
 	err = s.bgpSrv.AddPeerGroup(s.ctx, &bgpapi.AddPeerGroupRequest{
 		PeerGroup: &bgpapi.PeerGroup{
 			Conf: &bgpapi.PeerGroupConf{
@@ -164,6 +178,51 @@ func (s *Server) DeleteIPv6Net(ipnet net.IPNet) error {
 	})
 }
 
+// IPv6Exported reports whether IPv6 routes reach anyone: the IPv6 next hop is configured
+// and at least one established peer has negotiated the IPv6 unicast family
+func (s *Server) IPv6Exported() bool {
+	return s.ipv6Exported.Load()
+}
+
+func (s *Server) refreshIPv6Exported() {
+	if s.cfg.nextHopIPv6 == "" {
+		return
+	}
+
+	exported := s.listIPv6Exported()
+	if s.ipv6Exported.Swap(exported) != exported {
+		log.Info().
+			Bool("ipv6_exported", exported).
+			Msg("IPv6 routes export changed")
+	}
+}
+
+func (s *Server) listIPv6Exported() bool {
+	var exported bool
+	err := s.bgpSrv.ListPeer(s.ctx, &bgpapi.ListPeerRequest{}, func(peer *bgpapi.Peer) {
+		if peer.State == nil || peer.State.SessionState != bgpapi.PeerState_ESTABLISHED {
+			return
+		}
+
+		for _, afiSafi := range peer.AfiSafis {
+			if afiSafi.State == nil || !afiSafi.State.Enabled || afiSafi.State.Family == nil {
+				continue
+			}
+
+			family := afiSafi.State.Family
+			if family.Afi == bgpdef.V6Family.Afi && family.Safi == bgpdef.V6Family.Safi {
+				exported = true
+			}
+		}
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("unable to list peers")
+		return false
+	}
+
+	return exported
+}
+
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.shutdownFn()
 
@@ -0,0 +1,107 @@
+package deblocker
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// how often the expired holds of the never withdrawn routes are forgotten
+	routeHoldPrunePeriod = 1 * time.Minute
+)
+
+// routeHold tracks the last moment when clients may still use the IP: routes must not be withdrawn
+// before the last TTL handed out to a client has expired
+type routeHold struct {
+	mu       sync.Mutex
+	holds    map[string]time.Time
+	timers   map[*time.Timer]struct{}
+	stopped  bool
+	prunedAt time.Time
+}
+
+func newRouteHold() *routeHold {
+	return &routeHold{
+		holds:  make(map[string]time.Time),
+		timers: make(map[*time.Timer]struct{}),
+	}
+}
+
+func (h *routeHold) Extend(ip string, ttl time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(h.prunedAt) >= routeHoldPrunePeriod {
+		h.lockedPrune(now)
+	}
+
+	until := now.Add(ttl)
+	if cur, ok := h.holds[ip]; !ok || until.After(cur) {
+		h.holds[ip] = until
+	}
+}
+
+// Remaining returns how long the route to the IP must be kept, the expired holds are forgotten
+func (h *routeHold) Remaining(ip string) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	until, ok := h.holds[ip]
+	if !ok {
+		return 0
+	}
+
+	remaining := time.Until(until)
+	if remaining <= 0 {
+		delete(h.holds, ip)
+		return 0
+	}
+
+	return remaining
+}
+
+// Defer calls fn after the delay (e.g. to withdraw the held route), unless the hold is stopped before that
+func (h *routeHold) Defer(delay time.Duration, fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stopped {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		h.mu.Lock()
+		_, ok := h.timers[timer]
+		delete(h.timers, timer)
+		h.mu.Unlock()
+
+		if ok {
+			fn()
+		}
+	})
+	h.timers[timer] = struct{}{}
+}
+
+// Stop cancels the deferred calls, so nothing touches the routes after the shutdown
+func (h *routeHold) Stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stopped = true
+	for timer := range h.timers {
+		timer.Stop()
+		delete(h.timers, timer)
+	}
+}
+
+func (h *routeHold) lockedPrune(now time.Time) {
+	for ip, until := range h.holds {
+		if !until.After(now) {
+			delete(h.holds, ip)
+		}
+	}
+
+	h.prunedAt = now
+}
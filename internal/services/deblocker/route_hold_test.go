@@ -0,0 +1,39 @@
+package deblocker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRouteHoldDefer(t *testing.T) {
+	h := newRouteHold()
+
+	fired := make(chan string, 3)
+	h.Defer(time.Millisecond, func() { fired <- "first" })
+	h.Defer(time.Hour, func() { fired <- "stopped" })
+
+	select {
+	case got := <-fired:
+		if got != "first" {
+			t.Fatalf("fired: got %q, want %q", got, "first")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("deferred call didn't fire")
+	}
+
+	h.Stop()
+	h.Defer(0, func() { fired <- "after stop" })
+
+	h.mu.Lock()
+	pending := len(h.timers)
+	h.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("pending timers after stop: got %d, want 0", pending)
+	}
+
+	select {
+	case got := <-fired:
+		t.Fatalf("unexpected call after stop: %q", got)
+	default:
+	}
+}
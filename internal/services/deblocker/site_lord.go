@@ -13,6 +13,8 @@ import (
 	"golang.org/x/net/publicsuffix"
 
 	"github.com/buglloc/deblocker/internal/config"
+	"github.com/buglloc/deblocker/internal/dnscheck"
+	"github.com/buglloc/deblocker/internal/domains"
 	"github.com/buglloc/deblocker/internal/httpcheck"
 	"github.com/buglloc/deblocker/internal/services/bgpsrv"
 	"github.com/buglloc/deblocker/internal/services/dnssrv"
@@ -28,19 +30,41 @@ const (
 	DecisionVPNCheck
 )
 
+func (d Decision) String() string {
+	switch d {
+	case DecisionNone:
+		return "none"
+	case DecisionDirect:
+		return "direct"
+	case DecisionVPN:
+		return "vpn"
+	case DecisionDirectCheck:
+		return "direct_check"
+	case DecisionVPNCheck:
+		return "vpn_check"
+	default:
+		return fmt.Sprintf("decision_%d", d)
+	}
+}
+
 type siteRR struct {
 	dnssrv.RR
 	Site string
+	// done is closed when the check is finished, optional
+	done chan struct{}
 }
 
 type VPNSite struct {
 	mu           sync.Mutex
 	blockedFqdns map[string]struct{}
+	// tampered sites have no answers to recheck (bogus ones are never handled), so they live until the TTL expires
+	tampered bool
 }
 
 type SiteLord struct {
 	bgp           *bgpsrv.Server
 	hck           *httpcheck.Checker
+	dnsck         *dnscheck.Checker
 	concurrency   int
 	vpnSites      *ccache.Cache[*VPNSite]
 	vpnSitesTTL   time.Duration
@@ -48,10 +72,12 @@ type SiteLord struct {
 	decisionsTTL  time.Duration
 	dnsCache      *ccache.LayeredCache[dnssrv.RR]
 	dnsCacheTTL   time.Duration
+	routeHold     *routeHold
 	recheckPeriod time.Duration
 	checkQueue    chan siteRR
 	directDomains []string
 	vpnDomains    []string
+	syncCheck     bool
 	closed        chan struct{}
 	ctx           context.Context
 	shutdownFn    context.CancelFunc
@@ -68,18 +94,35 @@ func NewSiteLord(bgp *bgpsrv.Server, cfg config.Checker) (*SiteLord, error) {
 		return nil, fmt.Errorf("unable to create http checker: %w", err)
 	}
 
+	var dnsck *dnscheck.Checker
+	if cfg.ISPResolver != "" {
+		dnsck, err = dnscheck.NewChecker(
+			dnscheck.NewCheckerConfig().
+				WithResolver(cfg.ISPResolver).
+				WithDirectDev(cfg.DirectDev).
+				WithStubNets(cfg.ISPStubNets...).
+				Build(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create dns checker: %w", err)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	out := &SiteLord{
 		bgp:           bgp,
 		hck:           hck,
+		dnsck:         dnsck,
 		concurrency:   cfg.Concurrency,
 		checkQueue:    make(chan siteRR, cfg.QueueSize),
 		decisionsTTL:  cfg.DecisionsTTL,
 		dnsCacheTTL:   cfg.IPHistoryTTL,
+		routeHold:     newRouteHold(),
 		vpnSitesTTL:   cfg.VPNSitesTTL,
-		directDomains: normalizeDomains(cfg.DirectDomains),
-		vpnDomains:    normalizeDomains(cfg.VPNDomains),
+		directDomains: domains.Normalize(cfg.DirectDomains),
+		vpnDomains:    domains.Normalize(cfg.VPNDomains),
 		recheckPeriod: cfg.RecheckPeriod,
+		syncCheck:     cfg.SyncCheckTimeout > 0,
 		closed:        make(chan struct{}),
 		ctx:           ctx,
 		shutdownFn:    cancel,
@@ -127,6 +170,7 @@ func (l *SiteLord) Shutdown(ctx context.Context) error {
 	l.shutdownFn()
 
 	defer func() {
+		l.routeHold.Stop()
 		l.dnsCache.Stop()
 		l.decisions.Stop()
 	}()
@@ -144,41 +188,69 @@ func (l *SiteLord) checkWorker(toCheck <-chan siteRR) {
 	for rr := range toCheck {
 		ipStr := rr.IP.String()
 		isBlocked, _ := l.hck.IsBlocked(l.ctx, rr.FQDN, ipStr, rr.Kind)
+		isPoisoned := !isBlocked && l.isPoisoned(rr.FQDN, ipStr, rr.Kind)
+		isBlocked = isBlocked || isPoisoned
 		isVPNSite := l.isVpnSiteCached(rr.Site)
 		log.Debug().
 			Str("site", rr.Site).
 			Str("fqdn", rr.FQDN).
 			Str("ip", ipStr).
 			Bool("blocked", isBlocked).
+			Bool("poisoned", isPoisoned).
 			Bool("vpn_site", isVPNSite).
 			Msg("checked")
 
-		switch {
-		case !isBlocked && !isVPNSite:
+		if !isBlocked && !isVPNSite {
 			l.decisions.Set(rr.Site, DecisionDirect, l.decisionsTTL)
-		case isBlocked && !isVPNSite:
-			l.updateBGPRecords(rr.Site, false)
-			fallthrough
-		default:
-			cached, _ := l.vpnSites.Fetch(rr.Site, l.vpnSitesTTL, func() (*VPNSite, error) {
-				log.Info().
-					Str("source", "online_check").
-					Str("site", rr.Site).
-					Str("fqdn", rr.FQDN).
-					Str("ip", ipStr).
-					Msg("new blocked site detected")
-
-				return &VPNSite{
-					blockedFqdns: map[string]struct{}{},
-				}, nil
-			})
-			vpnSite := cached.Value()
-			vpnSite.mu.Lock()
-			vpnSite.blockedFqdns[rr.FQDN] = struct{}{}
-			vpnSite.mu.Unlock()
-			l.decisions.Set(rr.Site, DecisionVPN, l.decisionsTTL)
+		} else {
+			l.markVPNSite("online_check", rr.Site, rr.FQDN, ipStr)
 		}
+
+		if rr.done != nil {
+			close(rr.done)
+		}
+	}
+}
+
+// onTampered handles the names with bogus DNSSEC answers: somebody on the path injects them, so the site is blocked
+func (l *SiteLord) onTampered(fqdn string) {
+	site, err := siteFromFqdn(fqdn)
+	if err != nil {
+		return
+	}
+
+	item := l.markVPNSite("dnssec", site, fqdn, "")
+	vpnSite := item.Value()
+	vpnSite.mu.Lock()
+	vpnSite.tampered = true
+	vpnSite.mu.Unlock()
+	item.Extend(l.vpnSitesTTL)
+}
+
+// markVPNSite remembers the blocked fqdn of the site and routes the site over VPN
+func (l *SiteLord) markVPNSite(source, site, fqdn, ip string) *ccache.Item[*VPNSite] {
+	if !l.isVpnSiteCached(site) {
+		l.updateBGPRecords(site, false)
 	}
+
+	cached, _ := l.vpnSites.Fetch(site, l.vpnSitesTTL, func() (*VPNSite, error) {
+		log.Info().
+			Str("source", source).
+			Str("site", site).
+			Str("fqdn", fqdn).
+			Str("ip", ip).
+			Msg("new blocked site detected")
+
+		return &VPNSite{
+			blockedFqdns: map[string]struct{}{},
+		}, nil
+	})
+	vpnSite := cached.Value()
+	vpnSite.mu.Lock()
+	vpnSite.blockedFqdns[fqdn] = struct{}{}
+	vpnSite.mu.Unlock()
+	l.decisions.Set(site, DecisionVPN, l.decisionsTTL)
+	return cached
 }
 
 func (l *SiteLord) offlineWorker(recheckPeriod time.Duration) {
@@ -202,12 +274,20 @@ func (l *SiteLord) offlineWorker(recheckPeriod time.Duration) {
 
 			vpnSite := item.Value()
 			vpnSite.mu.Lock()
+			tampered := vpnSite.tampered
 			fqdns := make([]string, 0, len(vpnSite.blockedFqdns))
 			for fqdn := range vpnSite.blockedFqdns {
 				fqdns = append(fqdns, fqdn)
 			}
 			vpnSite.mu.Unlock()
 
+			if tampered {
+				logger.Debug().
+					Str("site", site).
+					Msg("site has tampered DNSSEC answers, keep it until its state TTL expires")
+				return true
+			}
+
 			var siteBlocked bool
 			for _, fqdn := range fqdns {
 				var rrs []dnssrv.RR
@@ -231,7 +311,7 @@ func (l *SiteLord) offlineWorker(recheckPeriod time.Duration) {
 							Msg("unable to check blocked state")
 					}
 
-					if blocked {
+					if blocked || l.isPoisoned(fqdn, ipStr, rr.Kind) {
 						isBlocked = true
 						break
 					}
@@ -265,7 +345,38 @@ func (l *SiteLord) offlineWorker(recheckPeriod time.Duration) {
 	}
 }
 
+// isPoisoned reports whether the in-country resolver lies about the fqdn, which is the blocking signal as well
+func (l *SiteLord) isPoisoned(fqdn, ip string, ipKind dnssrv.IPKind) bool {
+	if l.dnsck == nil {
+		return false
+	}
+
+	poisoned, err := l.dnsck.IsPoisoned(l.ctx, fqdn, ip, ipKind)
+	if err != nil {
+		log.Debug().
+			Str("fqdn", fqdn).
+			Str("ip", ip).
+			Err(err).
+			Msg("unable to check DNS poisoning")
+		return false
+	}
+
+	return poisoned
+}
+
 func (l *SiteLord) deleteRR(rr dnssrv.RR) {
+	if remaining := l.routeHold.Remaining(rr.IP.String()); remaining > 0 {
+		log.Debug().
+			Str("fqdn", rr.FQDN).
+			Str("ip", rr.IP.String()).
+			Dur("hold", remaining).
+			Msg("route is held down by clients TTL")
+		l.routeHold.Defer(remaining, func() {
+			l.deleteRR(rr)
+		})
+		return
+	}
+
 	var err error
 	switch rr.Kind {
 	case dnssrv.IPKindV4:
@@ -312,40 +423,175 @@ func (l *SiteLord) updateBGPRecords(site string, delete bool) {
 	})
 }
 
-func (l *SiteLord) onResolvedIP(rr dnssrv.RR) {
+func (l *SiteLord) onResolvedIP(ctx context.Context, rr dnssrv.RR) dnssrv.Verdict {
 	site, err := siteFromFqdn(rr.FQDN)
 	if err != nil {
 		log.Warn().Str("fqdn", rr.FQDN).Err(err).Msg("unable to get site from fqdn")
 	} else {
-		ipKey := rr.FQDN + rr.IP.String()
-		if item := l.dnsCache.GetWithoutPromote(site, ipKey); item == nil {
-			l.dnsCache.Set(site, ipKey, rr, l.dnsCacheTTL)
-		} else {
-			item.Extend(l.dnsCacheTTL)
-		}
+		l.rememberRR(site, rr)
 	}
 
-	switch l.fqdnDecision(rr.FQDN, site) {
+	decision, decisionSite := l.rrDecision(rr, site)
+	switch decision {
 	case DecisionDirect:
 	case DecisionVPN:
 		l.upsertRR(rr)
+		return l.routedVerdict(rr, decision)
 	case DecisionVPNCheck:
 		l.upsertRR(rr)
-		fallthrough
+		l.enqueueCheck(ctx, siteRR{
+			RR:   rr,
+			Site: decisionSite,
+		})
+		return l.routedVerdict(rr, decision)
 	case DecisionDirectCheck:
-		l.checkQueue <- siteRR{
+		toCheck := siteRR{
 			RR:   rr,
-			Site: site,
+			Site: decisionSite,
 		}
-		return
+		if !l.syncCheck {
+			l.enqueueCheck(ctx, toCheck)
+			return l.heldVerdict(rr, decision)
+		}
+
+		// unknown site: hold the answer until the check is finished, so the first connection goes the right way
+		toCheck.done = make(chan struct{})
+		if !l.enqueueCheck(ctx, toCheck) {
+			return l.heldVerdict(rr, decision)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Debug().
+				Str("site", decisionSite).
+				Str("fqdn", rr.FQDN).
+				Str("ip", rr.IP.String()).
+				Msg("sync check timed out")
+			return l.heldVerdict(rr, decision)
+		case <-toCheck.done:
+			if l.isVpnSiteCached(decisionSite) {
+				return l.routedVerdict(rr, DecisionVPN)
+			}
+		}
+	}
+
+	return dnssrv.Verdict{
+		Decision: decision.String(),
+	}
+}
+
+// routing tells whether the name (or its CNAME target) is routed over VPN, w/o any side effects
+func (l *SiteLord) routing(fqdn string, chain []string) dnssrv.Routing {
+	isVPN := l.isVPNName(fqdn)
+	if !isVPN && len(chain) > 0 {
+		isVPN = l.isVPNName(chain[len(chain)-1])
+	}
+
+	if !isVPN {
+		return dnssrv.Routing{}
+	}
+
+	return dnssrv.Routing{
+		VPN:  true,
+		IPv6: l.bgp.IPv6Exported(),
+	}
+}
+
+func (l *SiteLord) isVPNName(fqdn string) bool {
+	site, _ := siteFromFqdn(fqdn)
+	switch l.fqdnDecision(fqdn, site) {
+	case DecisionVPN, DecisionVPNCheck:
+		return true
+	default:
+		return false
+	}
+}
+
+// routedVerdict limits the answer TTL by the route lifetime and holds the route until the answer expires
+func (l *SiteLord) routedVerdict(rr dnssrv.RR, decision Decision) dnssrv.Verdict {
+	out := l.heldVerdict(rr, decision)
+	out.Routed = true
+	return out
+}
+
+// heldVerdict is the routedVerdict for the IP that isn't routed yet, but may be once the pending check is done:
+// otherwise clients would keep the cached IP after the route is withdrawn
+func (l *SiteLord) heldVerdict(rr dnssrv.RR, decision Decision) dnssrv.Verdict {
+	maxTTL := uint32(l.dnsCacheTTL / time.Second)
+	ttl := rr.TTL
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	l.routeHold.Extend(rr.IP.String(), time.Duration(ttl)*time.Second)
+	return dnssrv.Verdict{
+		MaxTTL:   maxTTL,
+		Decision: decision.String(),
+	}
+}
+
+// enqueueCheck waits for the room in the check queue: the sync checks are given up along with the held answer,
+// while the async ones are never retried, so they wait as long as the SiteLord is running
+func (l *SiteLord) enqueueCheck(ctx context.Context, rr siteRR) bool {
+	if rr.done == nil {
+		ctx = l.ctx
+	}
+
+	select {
+	case l.checkQueue <- rr:
+		return true
+	case <-ctx.Done():
+		log.Warn().
+			Str("site", rr.Site).
+			Str("fqdn", rr.FQDN).
+			Str("ip", rr.IP.String()).
+			Msg("check queue is full, check dropped")
+		return false
+	}
+}
+
+func (l *SiteLord) rememberRR(site string, rr dnssrv.RR) {
+	ipKey := rr.FQDN + rr.IP.String()
+	if item := l.dnsCache.GetWithoutPromote(site, ipKey); item == nil {
+		l.dnsCache.Set(site, ipKey, rr, l.dnsCacheTTL)
+	} else {
+		item.Extend(l.dnsCacheTTL)
+	}
+}
+
+// rrDecision makes decision for the queried site, but the CNAME target site may upgrade it to the VPN one,
+// since blocking is often applied to the CDN hostname rather than the brand domain
+func (l *SiteLord) rrDecision(rr dnssrv.RR, site string) (Decision, string) {
+	decision := l.fqdnDecision(rr.FQDN, site)
+	target := rr.Target()
+	if decision == DecisionVPN || target == rr.FQDN {
+		return decision, site
+	}
+
+	targetSite, err := siteFromFqdn(target)
+	if err != nil || targetSite == site {
+		return decision, site
+	}
+
+	l.rememberRR(targetSite, rr)
+	switch targetDecision := l.fqdnDecision(target, targetSite); targetDecision {
+	case DecisionVPN, DecisionVPNCheck:
+		log.Debug().
+			Str("fqdn", rr.FQDN).
+			Str("target", target).
+			Str("target_site", targetSite).
+			Msg("use CNAME target site decision")
+		return targetDecision, targetSite
+	default:
+		return decision, site
 	}
 }
 
 func (l *SiteLord) fqdnDecision(fqdn, site string) Decision {
 	switch {
-	case containsFqdn(l.directDomains, fqdn):
+	case domains.Contains(l.directDomains, fqdn):
 		return DecisionDirect
-	case containsFqdn(l.vpnDomains, fqdn):
+	case domains.Contains(l.vpnDomains, fqdn):
 		return DecisionVPN
 	case site == "":
 		// can't properly work w/o site
@@ -369,16 +615,6 @@ func (l *SiteLord) isVpnSiteCached(site string) bool {
 	return l.vpnSites.Get(site) != nil
 }
 
-func containsFqdn(fqdnSlice []string, fqdn string) bool {
-	for _, f := range fqdnSlice {
-		if fqdn == f || strings.HasSuffix(fqdn, f) {
-			return true
-		}
-	}
-
-	return false
-}
-
 func siteFromFqdn(fqdn string) (string, error) {
 	u, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimRight(fqdn, "."))
 	if err != nil {
@@ -401,12 +637,3 @@ func ipv6ToNet(addr net.IP) net.IPNet {
 		Mask: net.CIDRMask(32, 8*net.IPv6len),
 	}
 }
-
-func normalizeDomains(domains []string) []string {
-	out := make([]string, len(domains))
-	for i, domain := range domains {
-		d := strings.Trim(domain, ".")
-		out[i] = fmt.Sprintf(".%s.", d)
-	}
-	return out
-}
@@ -3,6 +3,7 @@ package deblocker
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 
@@ -56,9 +57,42 @@ func NewServer(cfg *config.Config) (*Server, error) {
 			WithMaxTCPQueries(cfg.DNS.Server.MaxTCPQueries).
 			WithReadTimeout(cfg.DNS.Server.ReadTimeout).
 			WithWriteTimeout(cfg.DNS.Server.WriteTimeout).
-			WithHandler(srv.siteLord.onResolvedIP).Build(),
+			WithTLSCert(cfg.DNS.Server.TLSCert, cfg.DNS.Server.TLSKey).
+			WithTLSClientCA(cfg.DNS.Server.TLSClientCA).
+			WithAllowedClients(cfg.DNS.Server.AllowedNets...).
+			WithDeniedClients(cfg.DNS.Server.DeniedNets...).
+			WithRateLimit(
+				dnssrv.NewRateLimitConfig().
+					WithQPS(cfg.DNS.Server.RateLimit.QPS).
+					WithBurst(cfg.DNS.Server.RateLimit.Burst).
+					WithPrefixes(cfg.DNS.Server.RateLimit.IPv4Prefix, cfg.DNS.Server.RateLimit.IPv6Prefix).
+					WithSize(cfg.DNS.Server.RateLimit.Size).
+					WithAction(cfg.DNS.Server.RateLimit.Action).
+					Build(),
+			).
+			WithCache(dnsCache(cfg)).
+			WithPrefetch(
+				dnssrv.NewPrefetchConfig().
+					WithSize(cfg.DNS.Prefetch.Size).
+					WithMinHits(cfg.DNS.Prefetch.MinHits).
+					Build(),
+			).
+			WithLocal(dnsLocal(cfg)).
+			WithQueryLog(dnsQueryLog(cfg)).
+			WithDNSSEC(dnsDNSSEC(cfg)).
+			WithTamperHandler(srv.siteLord.onTampered).
+			WithDoHBypass(dnsDoHBypass(cfg)).
+			WithHandleTimeout(cfg.Checker.SyncCheckTimeout).
+			WithHandler(srv.siteLord.onResolvedIP).
+			WithRoutingLookup(srv.siteLord.routing).Build(),
 		dnssrv.NewClientConfig().
-			WithAddr(cfg.DNS.Client.Addr).
+			WithAddrs(cfg.DNS.Client.Upstreams()...).
+			WithStrategy(cfg.DNS.Client.Strategy).
+			WithRoutes(dnsRoutes(cfg)...).
+			WithDev(cfg.DNS.Client.Dev).
+			WithFwmark(cfg.DNS.Client.Fwmark).
+			WithECSMode(cfg.DNS.Client.ECS.Mode).
+			WithECSSubnets(cfg.DNS.Client.ECS.DirectSubnet, cfg.DNS.Client.ECS.VPNSubnet).
 			WithDialTimeout(cfg.DNS.Client.DialTimeout).
 			WithReadTimeout(cfg.DNS.Client.ReadTimeout).
 			WithWriteTimeout(cfg.DNS.Client.WriteTimeout).
@@ -116,3 +150,90 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		return nil
 	}
 }
+
+func dnsRoutes(cfg *config.Config) []*dnssrv.RouteConfig {
+	out := make([]*dnssrv.RouteConfig, len(cfg.DNS.Client.Routes))
+	for i, route := range cfg.DNS.Client.Routes {
+		routeDomains := append([]string(nil), route.Domains...)
+		if route.IncludeVPNDomains {
+			routeDomains = append(routeDomains, cfg.Checker.VPNDomains...)
+		}
+
+		out[i] = dnssrv.NewRouteConfig().
+			WithDomains(routeDomains...).
+			WithAddrs(route.Addrs...).
+			WithStrategy(route.Strategy).
+			WithDev(route.Dev).
+			WithFwmark(route.Fwmark).
+			WithLocalZone(route.LocalZone).
+			Build()
+	}
+
+	return out
+}
+
+func dnsCache(cfg *config.Config) *dnssrv.CacheConfig {
+	var staleTTL time.Duration
+	if cfg.DNS.Cache.ServeStale {
+		staleTTL = cfg.DNS.Cache.StaleTTL
+	}
+
+	return dnssrv.NewCacheConfig().
+		WithSize(cfg.DNS.Cache.Size).
+		WithMinTTL(cfg.DNS.Cache.MinTTL).
+		WithMaxTTL(cfg.DNS.Cache.MaxTTL).
+		WithNegativeTTL(cfg.DNS.Cache.NegativeTTL).
+		WithStaleTTL(staleTTL).
+		Build()
+}
+
+func dnsLocal(cfg *config.Config) *dnssrv.LocalConfig {
+	out := dnssrv.NewLocalConfig().
+		WithTTL(cfg.DNS.Local.TTL).
+		WithReloadPeriod(cfg.DNS.Local.ReloadPeriod).
+		WithHostsFiles(cfg.DNS.Local.HostsFiles...).
+		WithObservable(cfg.DNS.Local.Observable)
+
+	for _, rec := range cfg.DNS.Local.Records {
+		out.WithRecord(rec.Name, rec.Type, rec.Value)
+	}
+
+	return out.Build()
+}
+
+func dnsQueryLog(cfg *config.Config) *dnssrv.QueryLogConfig {
+	out := dnssrv.NewQueryLogConfig().
+		WithPath(cfg.DNS.QueryLog.Path).
+		WithMaxSize(cfg.DNS.QueryLog.MaxSizeMB << 20).
+		WithRotatePeriod(cfg.DNS.QueryLog.RotatePeriod).
+		WithMaxBackups(cfg.DNS.QueryLog.MaxBackups).
+		WithSampleRate(cfg.DNS.QueryLog.SampleRate)
+
+	for _, client := range cfg.DNS.QueryLog.Clients {
+		out.WithClientSampleRate(client.SampleRate, client.Nets...)
+	}
+
+	return out.Build()
+}
+
+func dnsDNSSEC(cfg *config.Config) *dnssrv.DNSSECConfig {
+	if !cfg.DNS.DNSSEC.Validate {
+		return nil
+	}
+
+	return dnssrv.NewDNSSECConfig().
+		WithTrustAnchors(cfg.DNS.DNSSEC.TrustAnchors...).
+		Build()
+}
+
+func dnsDoHBypass(cfg *config.Config) *dnssrv.DoHBypassConfig {
+	if !cfg.DNS.DoHBypass.Enabled {
+		return nil
+	}
+
+	return dnssrv.NewDoHBypassConfig().
+		WithCanary(cfg.DNS.DoHBypass.Canary).
+		WithDomains(cfg.DNS.DoHBypass.Domains...).
+		WithAction(cfg.DNS.DoHBypass.Action).
+		Build()
+}
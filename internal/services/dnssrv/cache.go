@@ -0,0 +1,222 @@
+package dnssrv
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/karlseguin/ccache/v3"
+	"github.com/miekg/dns"
+)
+
+const (
+	// RFC 8767, section 4: TTL of the stale answers
+	staleAnswerTTL = 30
+)
+
+type cacheEntry struct {
+	rsp      *dns.Msg
+	storedAt time.Time
+	ttl      time.Duration
+}
+
+func (e *cacheEntry) isFresh(now time.Time) bool {
+	return now.Sub(e.storedAt) < e.ttl
+}
+
+type respCache struct {
+	items       *ccache.Cache[*cacheEntry]
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	staleTTL    time.Duration
+}
+
+func newRespCache(cfg *CacheConfig) *respCache {
+	return &respCache{
+		items: ccache.New(
+			ccache.Configure[*cacheEntry]().
+				MaxSize(cfg.size),
+		),
+		minTTL:      cfg.minTTL,
+		maxTTL:      cfg.maxTTL,
+		negativeTTL: cfg.negativeTTL,
+		staleTTL:    cfg.staleTTL,
+	}
+}
+
+// Get returns the fresh cached response for the request
+func (c *respCache) Get(req *dns.Msg) *dns.Msg {
+	entry := c.entry(req)
+	if entry == nil {
+		return nil
+	}
+
+	now := time.Now()
+	if !entry.isFresh(now) {
+		return nil
+	}
+
+	age := uint32(now.Sub(entry.storedAt) / time.Second)
+	return cachedReply(req, entry.rsp, func(ttl uint32) uint32 {
+		if ttl <= age {
+			return 0
+		}
+
+		return ttl - age
+	})
+}
+
+// GetStale returns the expired cached response for the request as described in RFC 8767
+func (c *respCache) GetStale(req *dns.Msg) *dns.Msg {
+	if c.staleTTL <= 0 {
+		return nil
+	}
+
+	entry := c.entry(req)
+	if entry == nil {
+		return nil
+	}
+
+	out := cachedReply(req, entry.rsp, func(uint32) uint32 {
+		return staleAnswerTTL
+	})
+
+	if opt := out.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+			InfoCode: dns.ExtendedErrorCodeStaleAnswer,
+		})
+	}
+	return out
+}
+
+func (c *respCache) Set(req, rsp *dns.Msg) {
+	key, ok := cacheKey(req)
+	if !ok {
+		return
+	}
+
+	ttl, ok := c.responseTTL(rsp)
+	if !ok {
+		return
+	}
+
+	c.items.Set(key, &cacheEntry{
+		rsp:      rsp.Copy(),
+		storedAt: time.Now(),
+		ttl:      ttl,
+	}, ttl+c.staleTTL)
+}
+
+func (c *respCache) Stop() {
+	c.items.Stop()
+}
+
+func (c *respCache) entry(req *dns.Msg) *cacheEntry {
+	key, ok := cacheKey(req)
+	if !ok {
+		return nil
+	}
+
+	item := c.items.Get(key)
+	if item == nil || item.Expired() {
+		return nil
+	}
+
+	return item.Value()
+}
+
+func (c *respCache) responseTTL(rsp *dns.Msg) (time.Duration, bool) {
+	if rsp.Truncated {
+		return 0, false
+	}
+
+	switch rsp.Rcode {
+	case dns.RcodeSuccess:
+		if len(rsp.Answer) == 0 {
+			return c.negativeResponseTTL(rsp), true
+		}
+	case dns.RcodeNameError:
+		return c.negativeResponseTTL(rsp), true
+	default:
+		return 0, false
+	}
+
+	ttl := time.Duration(minTTL(rsp.Answer)) * time.Second
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	return ttl, true
+}
+
+// negativeResponseTTL calculates TTL of the NXDOMAIN/NODATA response as described in RFC 2308, section 5
+func (c *respCache) negativeResponseTTL(rsp *dns.Msg) time.Duration {
+	for _, rr := range rsp.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+
+		out := time.Duration(ttl) * time.Second
+		if out > c.negativeTTL {
+			out = c.negativeTTL
+		}
+
+		return out
+	}
+
+	return c.negativeTTL
+}
+
+func cacheKey(req *dns.Msg) (string, bool) {
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		return "", false
+	}
+
+	var do bool
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	q := req.Question[0]
+	return fmt.Sprintf("%s:%d:%d:%t:%t:%s", strings.ToLower(q.Name), q.Qtype, q.Qclass, do, req.CheckingDisabled, ecsKey(req)), true
+}
+
+func cachedReply(req, cached *dns.Msg, ttlFn func(uint32) uint32) *dns.Msg {
+	out := cached.Copy()
+	out.Id = req.Id
+	out.Question = req.Question
+
+	for _, section := range [][]dns.RR{out.Answer, out.Ns, out.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			rr.Header().Ttl = ttlFn(rr.Header().Ttl)
+		}
+	}
+
+	return out
+}
+
+func minTTL(rrs []dns.RR) uint32 {
+	var out uint32
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < out {
+			out = rr.Header().Ttl
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,312 @@
+package dnssrv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestReq(name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(DefaultEDNSBufSize, false)
+	return req
+}
+
+func newTestRsp(req *dns.Msg, rcode int, answerTTLs ...uint32) *dns.Msg {
+	rsp := new(dns.Msg)
+	rsp.SetRcode(req, rcode)
+	rsp.SetEdns0(DefaultEDNSBufSize, false)
+	for i, ttl := range answerTTLs {
+		rsp.Answer = append(rsp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(192, 0, 2, byte(i+1)),
+		})
+	}
+	return rsp
+}
+
+func withSOA(rsp *dns.Msg, ttl, minTTL uint32) *dns.Msg {
+	rsp.Ns = append(rsp.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: minTTL,
+	})
+	return rsp
+}
+
+func TestRespCacheResponseTTL(t *testing.T) {
+	req := newTestReq("example.com.", dns.TypeA)
+	truncated := newTestRsp(req, dns.RcodeSuccess, 300)
+	truncated.Truncated = true
+
+	cases := []struct {
+		name   string
+		cfg    *CacheConfig
+		rsp    *dns.Msg
+		ttl    time.Duration
+		cached bool
+	}{
+		{
+			name:   "min answer TTL",
+			cfg:    NewCacheConfig(),
+			rsp:    newTestRsp(req, dns.RcodeSuccess, 300, 60, 600),
+			ttl:    60 * time.Second,
+			cached: true,
+		},
+		{
+			name:   "min TTL clamp",
+			cfg:    NewCacheConfig().WithMinTTL(2 * time.Minute),
+			rsp:    newTestRsp(req, dns.RcodeSuccess, 60),
+			ttl:    2 * time.Minute,
+			cached: true,
+		},
+		{
+			name:   "max TTL clamp",
+			cfg:    NewCacheConfig().WithMaxTTL(10 * time.Minute),
+			rsp:    newTestRsp(req, dns.RcodeSuccess, 86400),
+			ttl:    10 * time.Minute,
+			cached: true,
+		},
+		{
+			name:   "NXDOMAIN uses SOA minimum",
+			cfg:    NewCacheConfig(),
+			rsp:    withSOA(newTestRsp(req, dns.RcodeNameError), 3600, 120),
+			ttl:    2 * time.Minute,
+			cached: true,
+		},
+		{
+			name:   "NODATA uses SOA TTL",
+			cfg:    NewCacheConfig(),
+			rsp:    withSOA(newTestRsp(req, dns.RcodeSuccess), 30, 120),
+			ttl:    30 * time.Second,
+			cached: true,
+		},
+		{
+			name:   "negative TTL clamp",
+			cfg:    NewCacheConfig().WithNegativeTTL(time.Minute),
+			rsp:    withSOA(newTestRsp(req, dns.RcodeNameError), 3600, 3600),
+			ttl:    time.Minute,
+			cached: true,
+		},
+		{
+			name:   "negative w/o SOA",
+			cfg:    NewCacheConfig().WithNegativeTTL(time.Minute),
+			rsp:    newTestRsp(req, dns.RcodeNameError),
+			ttl:    time.Minute,
+			cached: true,
+		},
+		{
+			name: "SERVFAIL",
+			cfg:  NewCacheConfig(),
+			rsp:  newTestRsp(req, dns.RcodeServerFailure),
+		},
+		{
+			name: "truncated",
+			cfg:  NewCacheConfig(),
+			rsp:  truncated,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newRespCache(tc.cfg)
+			defer c.Stop()
+
+			ttl, cached := c.responseTTL(tc.rsp)
+			if cached != tc.cached {
+				t.Fatalf("cached: got %t, want %t", cached, tc.cached)
+			}
+
+			if ttl != tc.ttl {
+				t.Fatalf("TTL: got %s, want %s", ttl, tc.ttl)
+			}
+		})
+	}
+}
+
+func TestRespCacheGet(t *testing.T) {
+	cases := []struct {
+		name     string
+		staleTTL time.Duration
+		age      time.Duration
+		fresh    bool
+		stale    bool
+		ttl      uint32
+	}{
+		{
+			name:  "fresh",
+			fresh: true,
+			ttl:   300,
+		},
+		{
+			name:  "TTL decrement",
+			age:   100 * time.Second,
+			fresh: true,
+			ttl:   200,
+		},
+		{
+			name: "expired w/o stale",
+			age:  301 * time.Second,
+		},
+		{
+			name:     "stale window",
+			staleTTL: time.Hour,
+			age:      10 * time.Minute,
+			stale:    true,
+			ttl:      staleAnswerTTL,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newRespCache(NewCacheConfig().WithStaleTTL(tc.staleTTL))
+			defer c.Stop()
+
+			req := newTestReq("Example.com.", dns.TypeA)
+			c.Set(req, newTestRsp(req, dns.RcodeSuccess, 300))
+			c.entry(req).storedAt = time.Now().Add(-tc.age)
+
+			// case insensitive lookup with the other ID
+			lookup := newTestReq("example.COM.", dns.TypeA)
+			fresh := c.Get(lookup)
+			if (fresh != nil) != tc.fresh {
+				t.Fatalf("fresh: got %t, want %t", fresh != nil, tc.fresh)
+			}
+
+			stale := c.GetStale(lookup)
+			if (stale != nil) != tc.stale {
+				t.Fatalf("stale: got %t, want %t", stale != nil, tc.stale)
+			}
+
+			out := fresh
+			if !tc.fresh {
+				out = stale
+			}
+
+			if out == nil {
+				return
+			}
+
+			if out.Id != lookup.Id {
+				t.Fatalf("ID: got %d, want %d", out.Id, lookup.Id)
+			}
+
+			if ttl := out.Answer[0].Header().Ttl; ttl != tc.ttl {
+				t.Fatalf("TTL: got %d, want %d", ttl, tc.ttl)
+			}
+
+			if tc.stale && !hasEDE(out, dns.ExtendedErrorCodeStaleAnswer) {
+				t.Fatal("stale answer w/o EDE")
+			}
+		})
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	cases := []struct {
+		name  string
+		rcode int
+		err   error
+		stale bool
+	}{
+		{name: "transport error", err: errors.New("i/o timeout"), stale: true},
+		{name: "SERVFAIL", rcode: dns.RcodeServerFailure, stale: true},
+		{name: "REFUSED", rcode: dns.RcodeRefused, stale: true},
+		{name: "NXDOMAIN", rcode: dns.RcodeNameError},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newRespCache(NewCacheConfig().WithStaleTTL(time.Hour))
+			defer c.Stop()
+
+			req := newTestReq("example.com.", dns.TypeA)
+			c.Set(req, newTestRsp(req, dns.RcodeSuccess, 300))
+			c.entry(req).storedAt = time.Now().Add(-10 * time.Minute)
+
+			up := newTestUpstream()
+			up.set("example.com.", dns.TypeA, tc.rcode, nil, nil)
+			if tc.err != nil {
+				up.errs[up.key("example.com.", dns.TypeA)] = tc.err
+			}
+
+			s := &Server{
+				upstream: up,
+				cache:    c,
+				ctx:      context.Background(),
+			}
+
+			rsp, err := s.resolve(context.Background(), req)
+			if err != nil {
+				if tc.stale {
+					t.Fatalf("expected stale answer, got error: %v", err)
+				}
+				return
+			}
+
+			if isStale := hasEDE(rsp, dns.ExtendedErrorCodeStaleAnswer); isStale != tc.stale {
+				t.Fatalf("stale: got %t (%s), want %t", isStale, dns.RcodeToString[rsp.Rcode], tc.stale)
+			}
+
+			if !tc.stale && rsp.Rcode != tc.rcode {
+				t.Fatalf("rcode: got %s, want %s", dns.RcodeToString[rsp.Rcode], dns.RcodeToString[tc.rcode])
+			}
+		})
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	base := newTestReq("example.com.", dns.TypeA)
+	baseKey, _ := cacheKey(base)
+
+	withDO := newTestReq("example.com.", dns.TypeA)
+	withDO.IsEdns0().SetDo()
+
+	withCD := newTestReq("example.com.", dns.TypeA)
+	withCD.CheckingDisabled = true
+
+	cases := []struct {
+		name string
+		req  *dns.Msg
+		same bool
+	}{
+		{name: "case insensitive", req: newTestReq("EXAMPLE.com.", dns.TypeA), same: true},
+		{name: "qtype", req: newTestReq("example.com.", dns.TypeAAAA)},
+		{name: "DO bit", req: withDO},
+		{name: "CD bit", req: withCD},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, ok := cacheKey(tc.req)
+			if !ok {
+				t.Fatal("request must be cacheable")
+			}
+
+			if (key == baseKey) != tc.same {
+				t.Fatalf("key %q vs %q: same must be %t", key, baseKey, tc.same)
+			}
+		})
+	}
+}
+
+func hasEDE(rsp *dns.Msg, code uint16) bool {
+	opt := rsp.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok && ede.InfoCode == code {
+			return true
+		}
+	}
+
+	return false
+}
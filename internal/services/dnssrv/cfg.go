@@ -1,27 +1,66 @@
 package dnssrv
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/url"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
+
+	"github.com/buglloc/deblocker/internal/domains"
+	"github.com/buglloc/deblocker/internal/netutil"
 )
 
 const (
-	DefaultMaxTCPQueries = -1
-	DefaultTimeout       = 2 * time.Second
+	DefaultMaxTCPQueries       = -1
+	DefaultTimeout             = 2 * time.Second
+	DefaultCacheSize           = 8192
+	DefaultCacheMaxTTL         = 1 * time.Hour
+	DefaultCacheNegativeTTL    = 5 * time.Minute
+	DefaultLocalTTL            = 5 * time.Minute
+	DefaultLocalReloadPeriod   = 10 * time.Second
+	DefaultQueryLogMaxSize     = 100 << 20
+	DefaultQueryLogPeriod      = 24 * time.Hour
+	DefaultQueryLogBackups     = 7
+	DefaultPrefetchSize        = 4096
+	DefaultPrefetchMinHits     = 3
+	DefaultRateLimitSize       = 65536
+	DefaultRateLimitIPv4Prefix = 32
+	DefaultRateLimitIPv6Prefix = 56
 )
 
 type ServerConfig struct {
 	addrs         []*url.URL
 	handleFilters []handleFilter
+	observedNets  []*net.IPNet
+	observedKinds map[IPKind]struct{}
+	routingLookup RoutingLookup
 	handler       IPHandler
+	handleTimeout time.Duration
 	maxTCPQueries int
 	readTimeout   time.Duration
 	writeTimeout  time.Duration
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsClientCA   string
+	cache         *CacheConfig
+	local         *LocalConfig
+	queryLog      *QueryLogConfig
+	allowedNets   []*net.IPNet
+	deniedNets    []*net.IPNet
+	rateLimit     *RateLimitConfig
+	prefetch      *PrefetchConfig
+	dnssec        *DNSSECConfig
+	onTampered    TamperHandler
+	dohBypass     *DoHBypassConfig
 	err           error
 }
 
@@ -67,6 +106,7 @@ func (c *ServerConfig) WithObservableNets(nets ...string) *ServerConfig {
 		}
 		allowedNets[i] = ipnet
 	}
+	c.observedNets = allowedNets
 
 	c.handleFilters = append(c.handleFilters, func(_ RR, ip net.IP) bool {
 		for _, ipnet := range allowedNets {
@@ -89,6 +129,7 @@ func (c *ServerConfig) WithObservableIPKinds(kinds ...IPKind) *ServerConfig {
 	for _, k := range kinds {
 		allowedKinds[k] = struct{}{}
 	}
+	c.observedKinds = allowedKinds
 
 	c.handleFilters = append(c.handleFilters, func(rr RR, _ net.IP) bool {
 		_, ok := allowedKinds[rr.Kind]
@@ -97,11 +138,46 @@ func (c *ServerConfig) WithObservableIPKinds(kinds ...IPKind) *ServerConfig {
 	return c
 }
 
+// WithAllowedClients restricts recursion to the clients from the nets, others are REFUSED.
+// Empty list allows everyone.
+func (c *ServerConfig) WithAllowedClients(nets ...string) *ServerConfig {
+	var err error
+	c.allowedNets, err = parseCIDRs(nets)
+	if err != nil {
+		c.err = multierror.Append(c.err, fmt.Errorf("invalid allowed clients: %w", err))
+	}
+
+	return c
+}
+
+// WithDeniedClients REFUSEs clients from the nets, takes precedence over the allowed ones
+func (c *ServerConfig) WithDeniedClients(nets ...string) *ServerConfig {
+	var err error
+	c.deniedNets, err = parseCIDRs(nets)
+	if err != nil {
+		c.err = multierror.Append(c.err, fmt.Errorf("invalid denied clients: %w", err))
+	}
+
+	return c
+}
+
 func (c *ServerConfig) WithHandler(handler IPHandler) *ServerConfig {
 	c.handler = handler
 	return c
 }
 
+// WithRoutingLookup sets the lookup used to strip answers that can't be routed (e.g. AAAA of the VPN sites w/o IPv6 routes)
+func (c *ServerConfig) WithRoutingLookup(lookup RoutingLookup) *ServerConfig {
+	c.routingLookup = lookup
+	return c
+}
+
+// WithHandleTimeout enables concurrent handling of the answer IPs and sets the max time to wait for handlers
+func (c *ServerConfig) WithHandleTimeout(timeout time.Duration) *ServerConfig {
+	c.handleTimeout = timeout
+	return c
+}
+
 func (c *ServerConfig) WithMaxTCPQueries(maxQueries int) *ServerConfig {
 	c.maxTCPQueries = maxQueries
 	return c
@@ -113,7 +189,62 @@ func (c *ServerConfig) WithReadTimeout(timeout time.Duration) *ServerConfig {
 }
 
 func (c *ServerConfig) WithWriteTimeout(timeout time.Duration) *ServerConfig {
-	c.readTimeout = timeout
+	c.writeTimeout = timeout
+	return c
+}
+
+func (c *ServerConfig) WithTLSCert(certFile, keyFile string) *ServerConfig {
+	c.tlsCertFile = certFile
+	c.tlsKeyFile = keyFile
+	return c
+}
+
+// WithTLSClientCA sets the CA to verify the client certificates against: mTLS applies to DoT, DoH and DoQ listeners
+func (c *ServerConfig) WithTLSClientCA(caFile string) *ServerConfig {
+	c.tlsClientCA = caFile
+	return c
+}
+
+func (c *ServerConfig) WithCache(cache *CacheConfig) *ServerConfig {
+	c.cache = cache
+	return c
+}
+
+func (c *ServerConfig) WithLocal(local *LocalConfig) *ServerConfig {
+	c.local = local
+	return c
+}
+
+func (c *ServerConfig) WithQueryLog(queryLog *QueryLogConfig) *ServerConfig {
+	c.queryLog = queryLog
+	return c
+}
+
+func (c *ServerConfig) WithRateLimit(rateLimit *RateLimitConfig) *ServerConfig {
+	c.rateLimit = rateLimit
+	return c
+}
+
+func (c *ServerConfig) WithPrefetch(prefetch *PrefetchConfig) *ServerConfig {
+	c.prefetch = prefetch
+	return c
+}
+
+// WithDNSSEC enables DNSSEC validation of the upstream responses, nil disables it
+func (c *ServerConfig) WithDNSSEC(dnssec *DNSSECConfig) *ServerConfig {
+	c.dnssec = dnssec
+	return c
+}
+
+// WithTamperHandler sets the handler of the names with bogus DNSSEC responses
+func (c *ServerConfig) WithTamperHandler(handler TamperHandler) *ServerConfig {
+	c.onTampered = handler
+	return c
+}
+
+// WithDoHBypass enables the DoH bypass countermeasures, nil disables them
+func (c *ServerConfig) WithDoHBypass(dohBypass *DoHBypassConfig) *ServerConfig {
+	c.dohBypass = dohBypass
 	return c
 }
 
@@ -122,12 +253,552 @@ func (c *ServerConfig) Build() *ServerConfig {
 }
 
 func (c *ServerConfig) Validate() error {
-	return c.err
+	if c.err != nil {
+		return c.err
+	}
+
+	for _, addr := range c.addrs {
+		switch addr.Scheme {
+		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		case "https", "tls", "quic":
+			if c.tlsCertFile == "" || c.tlsKeyFile == "" {
+				return fmt.Errorf("TLS certificate and key must be set for addr %q", addr)
+			}
+		default:
+			return fmt.Errorf("unsupported scheme of addr %q: %s", addr, addr.Scheme)
+		}
+	}
+
+	if c.tlsClientCA != "" && c.tlsCertFile == "" {
+		return errors.New("TLS client CA requires TLS certificate to be set")
+	}
+
+	if c.cache != nil {
+		if err := c.cache.Validate(); err != nil {
+			return fmt.Errorf("invalid cache config: %w", err)
+		}
+	}
+
+	if c.local != nil {
+		if err := c.local.Validate(); err != nil {
+			return fmt.Errorf("invalid local records config: %w", err)
+		}
+	}
+
+	if c.queryLog != nil {
+		if err := c.queryLog.Validate(); err != nil {
+			return fmt.Errorf("invalid query log config: %w", err)
+		}
+	}
+
+	if c.rateLimit != nil {
+		if err := c.rateLimit.Validate(); err != nil {
+			return fmt.Errorf("invalid rate limit config: %w", err)
+		}
+	}
+
+	if c.prefetch != nil {
+		if err := c.prefetch.Validate(); err != nil {
+			return fmt.Errorf("invalid prefetch config: %w", err)
+		}
+	}
+
+	if c.dnssec != nil {
+		if err := c.dnssec.Validate(); err != nil {
+			return fmt.Errorf("invalid DNSSEC config: %w", err)
+		}
+	}
+
+	if c.dohBypass != nil {
+		if err := c.dohBypass.Validate(); err != nil {
+			return fmt.Errorf("invalid DoH bypass config: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (c *ServerConfig) newTLSConfig() (*tls.Config, error) {
+	if c.tlsCertFile == "" && c.tlsKeyFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.tlsCertFile, c.tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS certificate: %w", err)
+	}
+
+	out := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.tlsClientCA == "" {
+		return out, nil
+	}
+
+	caPEM, err := os.ReadFile(c.tlsClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read TLS client CA: %w", err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in TLS client CA %q", c.tlsClientCA)
+	}
+
+	out.ClientCAs = clientCAs
+	out.ClientAuth = tls.RequireAndVerifyClientCert
+	return out, nil
+}
+
+type CacheConfig struct {
+	size        int64
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	staleTTL    time.Duration
+}
+
+func NewCacheConfig() *CacheConfig {
+	return &CacheConfig{
+		size:        DefaultCacheSize,
+		maxTTL:      DefaultCacheMaxTTL,
+		negativeTTL: DefaultCacheNegativeTTL,
+	}
+}
+
+// WithSize sets max number of cached responses, zero disables caching at all
+func (c *CacheConfig) WithSize(size int64) *CacheConfig {
+	c.size = size
+	return c
+}
+
+func (c *CacheConfig) WithMinTTL(ttl time.Duration) *CacheConfig {
+	c.minTTL = ttl
+	return c
+}
+
+func (c *CacheConfig) WithMaxTTL(ttl time.Duration) *CacheConfig {
+	c.maxTTL = ttl
+	return c
+}
+
+func (c *CacheConfig) WithNegativeTTL(ttl time.Duration) *CacheConfig {
+	c.negativeTTL = ttl
+	return c
+}
+
+// WithStaleTTL sets how long expired responses may be served if upstreams are failed (RFC 8767), zero disables it
+func (c *CacheConfig) WithStaleTTL(ttl time.Duration) *CacheConfig {
+	c.staleTTL = ttl
+	return c
+}
+
+func (c *CacheConfig) Build() *CacheConfig {
+	return c
+}
+
+func (c *CacheConfig) Validate() error {
+	if c.maxTTL > 0 && c.minTTL > c.maxTTL {
+		return fmt.Errorf("min TTL (%s) is greater than max TTL (%s)", c.minTTL, c.maxTTL)
+	}
+
+	if c.negativeTTL < 0 || c.staleTTL < 0 {
+		return errors.New("negative and stale TTLs can't be negative")
+	}
+
+	return nil
+}
+
+type localRecordCfg struct {
+	name   string
+	rrType string
+	value  string
+}
+
+func (r localRecordCfg) toRR(ttl time.Duration) (dns.RR, error) {
+	switch r.rrType {
+	case "A", "AAAA", "CNAME":
+	default:
+		return nil, fmt.Errorf("unsupported type of local record %q: %s", r.name, r.rrType)
+	}
+
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(r.name), int64(ttl/time.Second), r.rrType, r.value))
+}
+
+type LocalConfig struct {
+	records      []localRecordCfg
+	hostsFiles   []string
+	ttl          time.Duration
+	reloadPeriod time.Duration
+	observable   bool
+	err          error
+}
+
+func NewLocalConfig() *LocalConfig {
+	return &LocalConfig{
+		ttl:          DefaultLocalTTL,
+		reloadPeriod: DefaultLocalReloadPeriod,
+	}
+}
+
+// WithRecord adds the local record of the A, AAAA or CNAME type
+func (c *LocalConfig) WithRecord(name, rrType, value string) *LocalConfig {
+	rec := localRecordCfg{
+		name:   name,
+		rrType: strings.ToUpper(rrType),
+		value:  value,
+	}
+
+	if _, err := rec.toRR(c.ttl); err != nil {
+		c.err = multierror.Append(c.err, fmt.Errorf("invalid local record %q: %w", name, err))
+		return c
+	}
+
+	c.records = append(c.records, rec)
+	return c
+}
+
+func (c *LocalConfig) WithHostsFiles(paths ...string) *LocalConfig {
+	c.hostsFiles = append(c.hostsFiles, paths...)
+	return c
+}
+
+func (c *LocalConfig) WithTTL(ttl time.Duration) *LocalConfig {
+	c.ttl = ttl
+	return c
+}
+
+// WithReloadPeriod sets how often hosts files are checked for changes, zero disables reloading
+func (c *LocalConfig) WithReloadPeriod(period time.Duration) *LocalConfig {
+	c.reloadPeriod = period
+	return c
+}
+
+// WithObservable passes local answers to the IP handler, so they can be force-routed
+func (c *LocalConfig) WithObservable(observable bool) *LocalConfig {
+	c.observable = observable
+	return c
+}
+
+func (c *LocalConfig) Build() *LocalConfig {
+	return c
+}
+
+func (c *LocalConfig) Validate() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	if c.ttl < 0 {
+		return errors.New("TTL can't be negative")
+	}
+
+	return nil
+}
+
+func (c *LocalConfig) isEmpty() bool {
+	return len(c.records) == 0 && len(c.hostsFiles) == 0
+}
+
+type QueryLogConfig struct {
+	path         string
+	maxSize      int64
+	rotatePeriod time.Duration
+	maxBackups   int
+	sampleRate   float64
+	clientRates  []clientSampleRate
+	err          error
+}
+
+func NewQueryLogConfig() *QueryLogConfig {
+	return &QueryLogConfig{
+		maxSize:      DefaultQueryLogMaxSize,
+		rotatePeriod: DefaultQueryLogPeriod,
+		maxBackups:   DefaultQueryLogBackups,
+		sampleRate:   1,
+	}
+}
+
+// WithPath sets the query log file, empty path disables query logging
+func (c *QueryLogConfig) WithPath(path string) *QueryLogConfig {
+	c.path = path
+	return c
+}
+
+// WithMaxSize sets the size in bytes after which the file is rotated, zero disables size-based rotation
+func (c *QueryLogConfig) WithMaxSize(size int64) *QueryLogConfig {
+	c.maxSize = size
+	return c
+}
+
+// WithRotatePeriod sets how often the file is rotated, zero disables time-based rotation
+func (c *QueryLogConfig) WithRotatePeriod(period time.Duration) *QueryLogConfig {
+	c.rotatePeriod = period
+	return c
+}
+
+// WithMaxBackups sets how many rotated files are kept, zero keeps all of them
+func (c *QueryLogConfig) WithMaxBackups(backups int) *QueryLogConfig {
+	c.maxBackups = backups
+	return c
+}
+
+// WithSampleRate sets the fraction of the logged queries: 1 logs all of them, 0 logs nothing
+func (c *QueryLogConfig) WithSampleRate(rate float64) *QueryLogConfig {
+	c.sampleRate = rate
+	return c
+}
+
+// WithClientSampleRate overrides the sample rate for the clients from the nets
+func (c *QueryLogConfig) WithClientSampleRate(rate float64, nets ...string) *QueryLogConfig {
+	clientNets, err := parseCIDRs(nets)
+	if err != nil {
+		c.err = multierror.Append(c.err, fmt.Errorf("invalid client nets: %w", err))
+	}
+
+	c.clientRates = append(c.clientRates, clientSampleRate{
+		nets: clientNets,
+		rate: rate,
+	})
+	return c
+}
+
+func (c *QueryLogConfig) Build() *QueryLogConfig {
+	return c
+}
+
+func (c *QueryLogConfig) Validate() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	if c.maxSize < 0 || c.rotatePeriod < 0 || c.maxBackups < 0 {
+		return errors.New("max size, rotate period and max backups can't be negative")
+	}
+
+	if c.sampleRate < 0 || c.sampleRate > 1 {
+		return fmt.Errorf("sample rate must be in [0, 1]: %f", c.sampleRate)
+	}
+
+	for _, cr := range c.clientRates {
+		if cr.rate < 0 || cr.rate > 1 {
+			return fmt.Errorf("client sample rate must be in [0, 1]: %f", cr.rate)
+		}
+	}
+
+	return nil
+}
+
+type PrefetchConfig struct {
+	size    int
+	minHits int
+}
+
+func NewPrefetchConfig() *PrefetchConfig {
+	return &PrefetchConfig{
+		size:    DefaultPrefetchSize,
+		minHits: DefaultPrefetchMinHits,
+	}
+}
+
+// WithSize sets max number of the tracked names, zero disables prefetching
+func (c *PrefetchConfig) WithSize(size int) *PrefetchConfig {
+	c.size = size
+	return c
+}
+
+// WithMinHits sets how many times the name must be queried during its TTL to be refreshed before expiry
+func (c *PrefetchConfig) WithMinHits(hits int) *PrefetchConfig {
+	c.minHits = hits
+	return c
+}
+
+func (c *PrefetchConfig) Build() *PrefetchConfig {
+	return c
+}
+
+func (c *PrefetchConfig) Validate() error {
+	if c.size < 0 || c.minHits < 0 {
+		return errors.New("size and min hits can't be negative")
+	}
+
+	return nil
+}
+
+type DNSSECConfig struct {
+	trustAnchors []string
+}
+
+func NewDNSSECConfig() *DNSSECConfig {
+	return &DNSSECConfig{
+		trustAnchors: DefaultTrustAnchors,
+	}
+}
+
+// WithTrustAnchors sets the root DS records in the presentation format, e.g. ". IN DS 20326 8 2 E06D..."
+func (c *DNSSECConfig) WithTrustAnchors(anchors ...string) *DNSSECConfig {
+	if len(anchors) > 0 {
+		c.trustAnchors = anchors
+	}
+	return c
+}
+
+func (c *DNSSECConfig) Build() *DNSSECConfig {
+	return c
+}
+
+func (c *DNSSECConfig) Validate() error {
+	for _, anchor := range c.trustAnchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			return fmt.Errorf("invalid trust anchor %q: %w", anchor, err)
+		}
+
+		if ds, ok := rr.(*dns.DS); !ok || ds.Hdr.Name != "." {
+			return fmt.Errorf("trust anchor must be the root DS record: %s", anchor)
+		}
+	}
+
+	if len(c.trustAnchors) == 0 {
+		return errors.New("at least one trust anchor is required")
+	}
+
+	return nil
+}
+
+type DoHBypassConfig struct {
+	canary  bool
+	domains []string
+	action  DoHBypassAction
+}
+
+func NewDoHBypassConfig() *DoHBypassConfig {
+	return &DoHBypassConfig{
+		canary:  true,
+		domains: DefaultDoHBypassDomains,
+		action:  DoHBypassActionRefuse,
+	}
+}
+
+// WithCanary sets whether to answer the use-application-dns.net canary with NXDOMAIN
+func (c *DoHBypassConfig) WithCanary(canary bool) *DoHBypassConfig {
+	c.canary = canary
+	return c
+}
+
+// WithDomains overrides the DoH/DoT endpoints domains (with subdomains)
+func (c *DoHBypassConfig) WithDomains(domainNames ...string) *DoHBypassConfig {
+	if len(domainNames) > 0 {
+		c.domains = domainNames
+	}
+	return c
+}
+
+func (c *DoHBypassConfig) WithAction(action DoHBypassAction) *DoHBypassConfig {
+	c.action = action
+	return c
+}
+
+func (c *DoHBypassConfig) Build() *DoHBypassConfig {
+	return c
+}
+
+func (c *DoHBypassConfig) Validate() error {
+	switch c.action {
+	case DoHBypassActionRefuse, DoHBypassActionSinkhole:
+	default:
+		return fmt.Errorf("unsupported action: %s", c.action)
+	}
+
+	return nil
+}
+
+type RateLimitConfig struct {
+	qps        float64
+	burst      int
+	ipv4Prefix int
+	ipv6Prefix int
+	size       int64
+	action     RateLimitAction
+}
+
+func NewRateLimitConfig() *RateLimitConfig {
+	return &RateLimitConfig{
+		ipv4Prefix: DefaultRateLimitIPv4Prefix,
+		ipv6Prefix: DefaultRateLimitIPv6Prefix,
+		size:       DefaultRateLimitSize,
+		action:     RateLimitActionRefuse,
+	}
+}
+
+// WithQPS sets the allowed queries per second for the client, zero disables rate limiting
+func (c *RateLimitConfig) WithQPS(qps float64) *RateLimitConfig {
+	c.qps = qps
+	return c
+}
+
+// WithBurst sets the bucket size, defaults to the QPS
+func (c *RateLimitConfig) WithBurst(burst int) *RateLimitConfig {
+	c.burst = burst
+	return c
+}
+
+// WithPrefixes sets the prefix lengths the clients are grouped by
+func (c *RateLimitConfig) WithPrefixes(ipv4Prefix, ipv6Prefix int) *RateLimitConfig {
+	c.ipv4Prefix = ipv4Prefix
+	c.ipv6Prefix = ipv6Prefix
+	return c
+}
+
+// WithSize sets max number of the tracked clients
+func (c *RateLimitConfig) WithSize(size int64) *RateLimitConfig {
+	c.size = size
+	return c
+}
+
+// WithAction sets the response for over-limit queries
+func (c *RateLimitConfig) WithAction(action RateLimitAction) *RateLimitConfig {
+	c.action = action
+	return c
+}
+
+func (c *RateLimitConfig) Build() *RateLimitConfig {
+	if c.burst <= 0 {
+		c.burst = int(math.Ceil(c.qps))
+	}
+
+	return c
+}
+
+func (c *RateLimitConfig) Validate() error {
+	if c.qps < 0 {
+		return fmt.Errorf("QPS can't be negative: %f", c.qps)
+	}
+
+	if c.ipv4Prefix < 0 || c.ipv4Prefix > 32 {
+		return fmt.Errorf("invalid IPv4 prefix length: %d", c.ipv4Prefix)
+	}
+
+	if c.ipv6Prefix < 0 || c.ipv6Prefix > 128 {
+		return fmt.Errorf("invalid IPv6 prefix length: %d", c.ipv6Prefix)
+	}
+
+	if c.qps > 0 && c.size <= 0 {
+		return errors.New("size must be positive")
+	}
+
+	return nil
 }
 
 type ClientConfig struct {
-	net          string
-	addr         string
+	addrs        []*url.URL
+	strategy     UpstreamStrategy
+	routes       []*RouteConfig
+	dev          string
+	fwmark       uint32
+	ecs          ecsPolicy
 	dialTimeout  time.Duration
 	readTimeout  time.Duration
 	writeTimeout time.Duration
@@ -143,14 +814,64 @@ func NewClientConfig() *ClientConfig {
 }
 
 func (c *ClientConfig) WithAddr(addr string) *ClientConfig {
-	u, err := url.Parse(addr)
+	return c.WithAddrs(addr)
+}
+
+func (c *ClientConfig) WithAddrs(addrs ...string) *ClientConfig {
+	var err error
+	c.addrs, err = parseUpstreamAddrs(addrs)
 	if err != nil {
-		c.err = multierror.Append(c.err, fmt.Errorf("invlid addr: %w", err))
-		return c
+		c.err = multierror.Append(c.err, err)
+	}
+
+	return c
+}
+
+func (c *ClientConfig) WithStrategy(strategy UpstreamStrategy) *ClientConfig {
+	c.strategy = strategy
+	return c
+}
+
+// WithRoutes sets the per-domain upstreams. Answers of the split-horizon zones can't be validated with DNSSEC,
+// so such routes must be marked as the local zone (see RouteConfig.WithLocalZone)
+func (c *ClientConfig) WithRoutes(routes ...*RouteConfig) *ClientConfig {
+	c.routes = append(c.routes, routes...)
+	return c
+}
+
+func (c *ClientConfig) WithDev(dev string) *ClientConfig {
+	c.dev = dev
+	return c
+}
+
+func (c *ClientConfig) WithFwmark(mark uint32) *ClientConfig {
+	c.fwmark = mark
+	return c
+}
+
+// WithECSMode sets what EDNS Client Subnet is sent upstream: the client one, nothing or the fixed one (see WithECSSubnets)
+func (c *ClientConfig) WithECSMode(mode ECSMode) *ClientConfig {
+	c.ecs.mode = mode
+	return c
+}
+
+// WithECSSubnets sets the fixed ECS subnets for the directly routed names and for the VPN ones,
+// e.g. the VPN exit subnet to get CDN answers for the VPN exit region. Empty subnet means no ECS.
+func (c *ClientConfig) WithECSSubnets(directSubnet, vpnSubnet string) *ClientConfig {
+	parse := func(kind, cidr string) *net.IPNet {
+		if cidr == "" {
+			return nil
+		}
+
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			c.err = multierror.Append(c.err, fmt.Errorf("invalid %s ECS subnet %q: %w", kind, cidr, err))
+		}
+		return ipnet
 	}
 
-	c.net = u.Scheme
-	c.addr = u.Host
+	c.ecs.directSubnet = parse("direct", directSubnet)
+	c.ecs.vpnSubnet = parse("vpn", vpnSubnet)
 	return c
 }
 
@@ -178,9 +899,217 @@ func (c *ClientConfig) Validate() error {
 		return c.err
 	}
 
-	if c.addr == "" {
+	if err := validateUpstreamAddrs(c.addrs); err != nil {
+		return err
+	}
+
+	if c.dev != "" {
+		if err := netutil.CheckDev(c.dev); err != nil {
+			return fmt.Errorf("invalid device: %w", err)
+		}
+	}
+
+	if c.ecs.mode == ECSModeFixed && c.ecs.directSubnet == nil && c.ecs.vpnSubnet == nil {
+		return errors.New("fixed ECS mode requires direct and/or vpn subnet")
+	}
+
+	for i, route := range c.routes {
+		if err := route.Validate(); err != nil {
+			return fmt.Errorf("invalid route #%d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// localZones returns domains of the local zone routes
+func (c *ClientConfig) localZones() []string {
+	var out []string
+	for _, route := range c.routes {
+		if route.localZone {
+			out = append(out, route.domains...)
+		}
+	}
+
+	return out
+}
+
+func (c *ClientConfig) newUpstream() (Upstream, error) {
+	opts := upstreamOpts{
+		dialTimeout:  c.dialTimeout,
+		readTimeout:  c.readTimeout,
+		writeTimeout: c.writeTimeout,
+		control:      netutil.DialControl(c.dev, c.fwmark),
+	}
+
+	fallback, err := newUpstreamPoolFromAddrs(c.strategy, c.addrs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.routes) == 0 {
+		return fallback, nil
+	}
+
+	router := &upstreamRouter{
+		routes:   make([]upstreamRoute, len(c.routes)),
+		fallback: fallback,
+	}
+
+	for i, route := range c.routes {
+		routeOpts := opts
+		if route.dev != "" || route.fwmark != 0 {
+			routeOpts.control = netutil.DialControl(route.dev, route.fwmark)
+		}
+
+		upstream, err := newUpstreamPoolFromAddrs(route.strategy, route.addrs, routeOpts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route #%d: %w", i, err)
+		}
+
+		router.routes[i] = upstreamRoute{
+			domains:  route.domains,
+			upstream: upstream,
+		}
+	}
+
+	return router, nil
+}
+
+type RouteConfig struct {
+	domains   []string
+	addrs     []*url.URL
+	strategy  UpstreamStrategy
+	dev       string
+	fwmark    uint32
+	localZone bool
+	err       error
+}
+
+func NewRouteConfig() *RouteConfig {
+	return &RouteConfig{}
+}
+
+func (c *RouteConfig) WithDomains(domainNames ...string) *RouteConfig {
+	c.domains = domains.Normalize(domainNames)
+	return c
+}
+
+func (c *RouteConfig) WithAddrs(addrs ...string) *RouteConfig {
+	var err error
+	c.addrs, err = parseUpstreamAddrs(addrs)
+	if err != nil {
+		c.err = multierror.Append(c.err, err)
+	}
+
+	return c
+}
+
+func (c *RouteConfig) WithStrategy(strategy UpstreamStrategy) *RouteConfig {
+	c.strategy = strategy
+	return c
+}
+
+// WithDev overrides the client device for the route upstreams
+func (c *RouteConfig) WithDev(dev string) *RouteConfig {
+	c.dev = dev
+	return c
+}
+
+// WithFwmark overrides the client fwmark for the route upstreams
+func (c *RouteConfig) WithFwmark(mark uint32) *RouteConfig {
+	c.fwmark = mark
+	return c
+}
+
+// WithLocalZone marks the route domains as the local zone: answers are never passed to the IP handler
+// nor validated with DNSSEC, e.g. for home.arpa or lan served by the LAN resolver
+func (c *RouteConfig) WithLocalZone(localZone bool) *RouteConfig {
+	c.localZone = localZone
+	return c
+}
+
+func (c *RouteConfig) Build() *RouteConfig {
+	return c
+}
+
+func (c *RouteConfig) Validate() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	if len(c.domains) == 0 {
+		return errors.New("no domains")
+	}
+
+	if c.dev != "" {
+		if err := netutil.CheckDev(c.dev); err != nil {
+			return fmt.Errorf("invalid device: %w", err)
+		}
+	}
+
+	return validateUpstreamAddrs(c.addrs)
+}
+
+func parseUpstreamAddrs(addrs []string) ([]*url.URL, error) {
+	var errs error
+	out := make([]*url.URL, 0, len(addrs))
+	for _, addr := range addrs {
+		u, err := url.Parse(addr)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("invlid addr %q: %w", addr, err))
+			continue
+		}
+
+		out = append(out, u)
+	}
+
+	return out, errs
+}
+
+func validateUpstreamAddrs(addrs []*url.URL) error {
+	if len(addrs) == 0 {
 		return errors.New("upstream is not configured")
 	}
 
+	for _, addr := range addrs {
+		if addr.Host == "" {
+			return fmt.Errorf("invalid upstream %q: no host", addr)
+		}
+
+		switch addr.Scheme {
+		case "udp", "tcp", "tcp-tls", "tls", "https", "quic":
+		default:
+			return fmt.Errorf("unsupported scheme of upstream %q: %s", addr, addr.Scheme)
+		}
+	}
+
 	return nil
 }
+
+func newUpstreamPoolFromAddrs(strategy UpstreamStrategy, addrs []*url.URL, opts upstreamOpts) (*upstreamPool, error) {
+	upstreams := make([]Upstream, len(addrs))
+	for i, addr := range addrs {
+		var err error
+		upstreams[i], err = newUpstream(addr, opts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create upstream %q: %w", addr, err)
+		}
+	}
+
+	return newUpstreamPool(strategy, upstreams...), nil
+}
+
+func parseCIDRs(nets []string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0, len(nets))
+	for _, cidr := range nets {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q: %w", cidr, err)
+		}
+
+		out = append(out, ipnet)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,622 @@
+package dnssrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/karlseguin/ccache/v3"
+	"github.com/miekg/dns"
+)
+
+const (
+	dnssecKeysCacheSize = 4096
+	dnssecMaxKeysTTL    = 1 * time.Hour
+	dnssecMinKeysTTL    = 1 * time.Minute
+)
+
+// DefaultTrustAnchors are the root zone KSKs: KSK-2017 and KSK-2024
+var DefaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+var (
+	errDNSSECBogus = errors.New("DNSSEC validation failed")
+	errInsecure    = errors.New("zone is insecure")
+	errNotZoneCut  = errors.New("not a zone cut")
+)
+
+type zoneKeys struct {
+	keys []*dns.DNSKEY
+	// err is errInsecure or errNotZoneCut for zones w/o keys
+	err error
+}
+
+type rrset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+func (s *rrset) name() string {
+	return s.rrs[0].Header().Name
+}
+
+func (s *rrset) rrtype() uint16 {
+	return s.rrs[0].Header().Rrtype
+}
+
+// dnssecValidator validates upstream responses building the chain of trust from the root trust anchors
+type dnssecValidator struct {
+	upstream Upstream
+	anchors  []*dns.DS
+	keys     *ccache.Cache[*zoneKeys]
+}
+
+func newDNSSECValidator(upstream Upstream, cfg *DNSSECConfig) *dnssecValidator {
+	anchors := make([]*dns.DS, 0, len(cfg.trustAnchors))
+	for _, anchor := range cfg.trustAnchors {
+		// already checked by DNSSECConfig.Validate
+		rr, _ := dns.NewRR(anchor)
+		anchors = append(anchors, rr.(*dns.DS))
+	}
+
+	return &dnssecValidator{
+		upstream: upstream,
+		anchors:  anchors,
+		keys: ccache.New(
+			ccache.Configure[*zoneKeys]().
+				MaxSize(dnssecKeysCacheSize),
+		),
+	}
+}
+
+// Validate reports whether the response is secure (signed with the chain of trust up to the root)
+// or insecure (belongs to the provably unsigned zone). Wrong or stripped signatures are reported as errDNSSECBogus,
+// as well as the answer records that the question name doesn't lead to through the CNAME/DNAME chain.
+// The NSEC(3) proofs aren't checked, so the denials and the wildcard answers are never reported as secure.
+func (v *dnssecValidator) Validate(ctx context.Context, rsp *dns.Msg) (bool, error) {
+	if rsp.Rcode != dns.RcodeSuccess && rsp.Rcode != dns.RcodeNameError {
+		return false, nil
+	}
+
+	sets := groupRRsets(rsp.Answer, rsp.Ns)
+	if len(sets) == 0 {
+		// NODATA w/o SOA, nothing to validate but it must be the insecure zone
+		if len(rsp.Question) == 0 {
+			return false, nil
+		}
+
+		if err := v.provenInsecure(ctx, rsp.Question[0].Name); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	var dnames []*rrset
+	for _, set := range sets {
+		if set.rrtype() == dns.TypeDNAME {
+			dnames = append(dnames, set)
+		}
+	}
+
+	secure := true
+	for _, set := range sets {
+		// CNAME synthesized from DNAME is never signed (RFC 6672, section 5.3.1)
+		if len(set.sigs) == 0 && set.rrtype() == dns.TypeCNAME && isSynthesizedCNAME(set, dnames) {
+			continue
+		}
+
+		if len(set.sigs) == 0 {
+			if err := v.provenInsecure(ctx, set.name()); err != nil {
+				return false, err
+			}
+
+			secure = false
+			continue
+		}
+
+		setSecure, err := v.verifyRRset(ctx, set)
+		if err != nil {
+			return false, err
+		}
+
+		secure = secure && setSecure && !isWildcardExpanded(set)
+	}
+
+	if len(rsp.Question) > 0 {
+		if err := v.checkChain(ctx, rsp.Question[0], groupRRsets(rsp.Answer)); err != nil {
+			return false, err
+		}
+	}
+
+	return secure && !isDenial(rsp), nil
+}
+
+func (v *dnssecValidator) Stop() {
+	v.keys.Stop()
+}
+
+// verifyRRset checks the RRset signatures: returns true if any of them is valid and false if the signer zone is insecure.
+// Failed chain of trust queries are returned as is, they don't prove the tampering.
+func (v *dnssecValidator) verifyRRset(ctx context.Context, set *rrset) (bool, error) {
+	lastErr := errors.New("no suitable signatures")
+	var queryErr error
+	for _, sig := range set.sigs {
+		if !dns.IsSubDomain(sig.SignerName, set.name()) {
+			continue
+		}
+
+		// DS is signed by the parent zone, otherwise we would loop forever
+		if set.rrtype() == dns.TypeDS && equalNames(sig.SignerName, set.name()) {
+			continue
+		}
+
+		keys, err := v.zoneKeys(ctx, sig.SignerName)
+		switch {
+		case errors.Is(err, errInsecure):
+			return false, nil
+		case errors.Is(err, errDNSSECBogus), errors.Is(err, errNotZoneCut):
+			lastErr = err
+			continue
+		case err != nil:
+			queryErr = err
+			continue
+		}
+
+		if err := verifySig(sig, keys, set.rrs); err != nil {
+			lastErr = err
+			continue
+		}
+
+		return true, nil
+	}
+
+	if queryErr != nil {
+		return false, queryErr
+	}
+
+	if errors.Is(lastErr, errDNSSECBogus) {
+		return false, lastErr
+	}
+
+	return false, fmt.Errorf("%w: %s %s: %v", errDNSSECBogus, set.name(), dns.TypeToString[set.rrtype()], lastErr)
+}
+
+// zoneKeys returns the validated DNSKEYs of the zone
+func (v *dnssecValidator) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+	if item := v.keys.Get(zone); item != nil && !item.Expired() {
+		return item.Value().keys, item.Value().err
+	}
+
+	keys, ttl, err := v.fetchZoneKeys(ctx, zone)
+	switch {
+	case err == nil:
+		v.keys.Set(zone, &zoneKeys{keys: keys}, ttl)
+	case errors.Is(err, errInsecure), errors.Is(err, errNotZoneCut):
+		v.keys.Set(zone, &zoneKeys{err: err}, dnssecMaxKeysTTL)
+	}
+
+	return keys, err
+}
+
+func (v *dnssecValidator) fetchZoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, time.Duration, error) {
+	dsSet := v.anchors
+	if zone != "." {
+		var err error
+		dsSet, err = v.fetchDS(ctx, zone)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	rsp, err := v.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var keys []*dns.DNSKEY
+	var keysSet *rrset
+	for _, set := range groupRRsets(rsp.Answer) {
+		if set.rrtype() != dns.TypeDNSKEY || !equalNames(set.name(), zone) {
+			continue
+		}
+
+		keysSet = set
+		for _, rr := range set.rrs {
+			keys = append(keys, rr.(*dns.DNSKEY))
+		}
+	}
+
+	if keysSet == nil {
+		return nil, 0, fmt.Errorf("%w: no DNSKEY for zone %s", errDNSSECBogus, zone)
+	}
+
+	// the DNSKEY RRset must be signed by the key referenced by the parent DS
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		for _, ds := range dsSet {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+
+			if keyDS := key.ToDS(ds.DigestType); keyDS != nil && strings.EqualFold(keyDS.Digest, ds.Digest) {
+				trusted = append(trusted, key)
+			}
+		}
+	}
+
+	var verified bool
+	for _, sig := range keysSet.sigs {
+		if verifySig(sig, trusted, keysSet.rrs) == nil {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, 0, fmt.Errorf("%w: DNSKEY of zone %s doesn't match DS", errDNSSECBogus, zone)
+	}
+
+	ttl := time.Duration(minTTL(keysSet.rrs)) * time.Second
+	switch {
+	case ttl < dnssecMinKeysTTL:
+		ttl = dnssecMinKeysTTL
+	case ttl > dnssecMaxKeysTTL:
+		ttl = dnssecMaxKeysTTL
+	}
+
+	return keys, ttl, nil
+}
+
+// fetchDS returns the validated DS records of the zone, errInsecure for the insecure delegation
+// and errNotZoneCut if the name is not a zone apex
+func (v *dnssecValidator) fetchDS(ctx context.Context, zone string) ([]*dns.DS, error) {
+	rsp, err := v.query(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, set := range groupRRsets(rsp.Answer) {
+		if set.rrtype() != dns.TypeDS || !equalNames(set.name(), zone) {
+			continue
+		}
+
+		secure, err := v.verifyRRset(ctx, set)
+		if err != nil {
+			return nil, err
+		}
+
+		if !secure {
+			return nil, errInsecure
+		}
+
+		out := make([]*dns.DS, len(set.rrs))
+		for i, rr := range set.rrs {
+			out[i] = rr.(*dns.DS)
+		}
+		return out, nil
+	}
+
+	// no DS: the parent must prove that either it's the insecure delegation or there is no zone cut at all
+	var denial []dns.RR
+	for _, set := range groupRRsets(rsp.Ns) {
+		if len(set.sigs) == 0 {
+			continue
+		}
+
+		secure, err := v.verifyRRset(ctx, set)
+		if err != nil {
+			return nil, err
+		}
+
+		if !secure {
+			return nil, errInsecure
+		}
+
+		switch set.rrtype() {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			denial = append(denial, set.rrs...)
+		}
+	}
+
+	if len(denial) == 0 {
+		return nil, fmt.Errorf("%w: no DS denial proof for %s", errDNSSECBogus, zone)
+	}
+
+	if isInsecureDelegation(zone, denial) {
+		return nil, errInsecure
+	}
+
+	return nil, errNotZoneCut
+}
+
+// checkChain follows the question name through the CNAME and DNAME links of the answer. The answer RRsets out of
+// this chain don't belong to the question, so the chain must end in the insecure zone to let them through:
+// otherwise the validated unsigned records of another zone could be passed off as the answer of the signed name
+func (v *dnssecValidator) checkChain(ctx context.Context, q dns.Question, answer []*rrset) error {
+	onChain := make(map[*rrset]bool, len(answer))
+	name := q.Name
+	last := name
+	for i := 0; i <= len(answer) && name != ""; i++ {
+		last = name
+		var next string
+		for _, set := range answer {
+			switch {
+			case set.rrtype() == dns.TypeDNAME:
+				target, ok := dnameTarget(name, set.rrs[0].(*dns.DNAME))
+				if !ok {
+					continue
+				}
+
+				onChain[set] = true
+				if next == "" {
+					next = target
+				}
+			case !equalNames(set.name(), name):
+			case q.Qtype == dns.TypeANY || set.rrtype() == q.Qtype:
+				onChain[set] = true
+			case set.rrtype() == dns.TypeCNAME:
+				onChain[set] = true
+				next = set.rrs[0].(*dns.CNAME).Target
+			}
+		}
+
+		name = next
+	}
+
+	for _, set := range answer {
+		if !onChain[set] {
+			return v.provenInsecure(ctx, last)
+		}
+	}
+
+	return nil
+}
+
+// provenInsecure walks the name ancestors from the root and returns nil if the name is under the insecure delegation
+func (v *dnssecValidator) provenInsecure(ctx context.Context, name string) error {
+	labels := dns.SplitDomainName(name)
+	for i := len(labels); i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		_, err := v.zoneKeys(ctx, zone)
+		switch {
+		case errors.Is(err, errInsecure):
+			return nil
+		case err == nil, errors.Is(err, errNotZoneCut):
+			continue
+		default:
+			return err
+		}
+	}
+
+	return fmt.Errorf("%w: missing signatures for %s in the signed zone", errDNSSECBogus, name)
+}
+
+func (v *dnssecValidator) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(DefaultEDNSBufSize, true)
+	req.CheckingDisabled = true
+
+	rsp, err := v.upstream.Exchange(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query %s %s: %w", name, dns.TypeToString[qtype], err)
+	}
+
+	switch rsp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		return rsp, nil
+	default:
+		return nil, fmt.Errorf("unable to query %s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[rsp.Rcode])
+	}
+}
+
+// isInsecureDelegation checks the DS denial proof: NSEC(3) of the name has NS but not DS
+// or the name is covered by the opt-out NSEC3 (RFC 5155, section 6)
+func isInsecureDelegation(name string, denial []dns.RR) bool {
+	for _, rr := range denial {
+		switch v := rr.(type) {
+		case *dns.NSEC:
+			if equalNames(v.Hdr.Name, name) {
+				return isDelegationWithoutDS(v.TypeBitMap)
+			}
+		case *dns.NSEC3:
+			if v.Match(name) {
+				return isDelegationWithoutDS(v.TypeBitMap)
+			}
+
+			if v.Flags&1 == 1 && v.Cover(name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isDelegationWithoutDS checks the NSEC(3) bitmap of the parent side of the zone cut, the child apex one has SOA
+func isDelegationWithoutDS(bitmap []uint16) bool {
+	return hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeDS) && !hasType(bitmap, dns.TypeSOA)
+}
+
+// isDenial reports whether the response is NXDOMAIN or NODATA, both are proven by NSEC(3) records
+func isDenial(rsp *dns.Msg) bool {
+	if rsp.Rcode == dns.RcodeNameError {
+		return true
+	}
+
+	if len(rsp.Question) == 0 {
+		return false
+	}
+
+	qtype := rsp.Question[0].Qtype
+	for _, rr := range rsp.Answer {
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isSynthesizedCNAME reports whether the CNAME is the DNAME substitution of its owner
+func isSynthesizedCNAME(set *rrset, dnames []*rrset) bool {
+	cname := set.rrs[0].(*dns.CNAME)
+	for _, dname := range dnames {
+		target, ok := dnameTarget(set.name(), dname.rrs[0].(*dns.DNAME))
+		if ok && equalNames(target, cname.Target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dnameTarget replaces the DNAME owner suffix of the name with the DNAME target (RFC 6672, section 2.2)
+func dnameTarget(name string, dname *dns.DNAME) (string, bool) {
+	if equalNames(name, dname.Hdr.Name) || !dns.IsSubDomain(dname.Hdr.Name, name) {
+		return "", false
+	}
+
+	labels := dns.SplitDomainName(name)
+	prefix := strings.Join(labels[:len(labels)-dns.CountLabel(dname.Hdr.Name)], ".")
+	if target := dns.Fqdn(dname.Target); target != "." {
+		return prefix + "." + target, true
+	}
+
+	return prefix + ".", true
+}
+
+// isWildcardExpanded reports whether the RRset is synthesized from the wildcard: the RRSIG labels field
+// doesn't count the expanded labels (RFC 4035, section 5.3.4), so NSEC(3) must prove there is no closer match
+func isWildcardExpanded(set *rrset) bool {
+	labels := dns.CountLabel(set.name())
+	if strings.HasPrefix(set.name(), "*.") {
+		labels--
+	}
+
+	for _, sig := range set.sigs {
+		if int(sig.Labels) < labels {
+			return true
+		}
+	}
+
+	return false
+}
+
+func verifySig(sig *dns.RRSIG, keys []*dns.DNSKEY, rrs []dns.RR) error {
+	if !sig.ValidityPeriod(time.Now()) {
+		return errors.New("signature is expired or not yet valid")
+	}
+
+	lastErr := errors.New("no matching key")
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+
+		if lastErr = sig.Verify(key, rrs); lastErr == nil {
+			return nil
+		}
+	}
+
+	return lastErr
+}
+
+// groupRRsets groups records by the owner and type with their signatures, the OPT ones are skipped
+func groupRRsets(sections ...[]dns.RR) []*rrset {
+	var out []*rrset
+	index := make(map[string]*rrset)
+	get := func(name string, rrtype uint16) *rrset {
+		key := fmt.Sprintf("%s:%d", dns.CanonicalName(name), rrtype)
+		set, ok := index[key]
+		if !ok {
+			set = &rrset{}
+			index[key] = set
+			out = append(out, set)
+		}
+		return set
+	}
+
+	for _, section := range sections {
+		for _, rr := range section {
+			switch v := rr.(type) {
+			case *dns.OPT:
+			case *dns.RRSIG:
+				set := get(v.Hdr.Name, v.TypeCovered)
+				set.sigs = append(set.sigs, v)
+			default:
+				set := get(rr.Header().Name, rr.Header().Rrtype)
+				set.rrs = append(set.rrs, rr)
+			}
+		}
+	}
+
+	// signatures w/o the signed records are useless
+	filtered := out[:0]
+	for _, set := range out {
+		if len(set.rrs) > 0 {
+			filtered = append(filtered, set)
+		}
+	}
+
+	return filtered
+}
+
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+func equalNames(a, b string) bool {
+	return strings.EqualFold(dns.Fqdn(a), dns.Fqdn(b))
+}
+
+// dnssecClientResponse hides DNSSEC details from the clients that didn't ask for them (RFC 4035, section 3.2.1 and
+// RFC 6840, section 5.8)
+func dnssecClientResponse(req, rsp *dns.Msg) {
+	var do bool
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	if !do && !req.AuthenticatedData {
+		rsp.AuthenticatedData = false
+	}
+
+	if do {
+		return
+	}
+
+	var qtype uint16
+	if len(req.Question) > 0 {
+		qtype = req.Question[0].Qtype
+	}
+
+	strip := func(rrs []dns.RR) []dns.RR {
+		out := rrs[:0]
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if rr.Header().Rrtype != qtype {
+					continue
+				}
+			}
+
+			out = append(out, rr)
+		}
+		return out
+	}
+
+	rsp.Answer = strip(rsp.Answer)
+	rsp.Ns = strip(rsp.Ns)
+}
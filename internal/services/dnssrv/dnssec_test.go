@@ -0,0 +1,387 @@
+package dnssrv
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testZone{
+		name: name,
+		key:  key,
+		priv: priv.(crypto.Signer),
+	}
+}
+
+func (z *testZone) ds() *dns.DS {
+	return z.key.ToDS(dns.SHA256)
+}
+
+// sign returns the records with their RRSIG valid from the inception till the expiration
+func (z *testZone) sign(t *testing.T, inception, expiration time.Time, rrs ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrs[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		SignerName: z.name,
+		KeyTag:     z.key.KeyTag(),
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+
+	return append(rrs, sig)
+}
+
+func (z *testZone) signNow(t *testing.T, rrs ...dns.RR) []dns.RR {
+	return z.sign(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), rrs...)
+}
+
+// testUpstream answers with the prepared responses, keyed by the question name and type
+type testUpstream struct {
+	rsps map[string]*dns.Msg
+	errs map[string]error
+}
+
+func newTestUpstream() *testUpstream {
+	return &testUpstream{
+		rsps: make(map[string]*dns.Msg),
+		errs: make(map[string]error),
+	}
+}
+
+func (u *testUpstream) key(name string, qtype uint16) string {
+	return dns.CanonicalName(name) + ":" + dns.TypeToString[qtype]
+}
+
+func (u *testUpstream) set(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+	rsp := new(dns.Msg)
+	rsp.Rcode = rcode
+	rsp.Answer = answer
+	rsp.Ns = ns
+	u.rsps[u.key(name, qtype)] = rsp
+}
+
+func (u *testUpstream) Exchange(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	if err := u.errs[u.key(q.Name, q.Qtype)]; err != nil {
+		return nil, err
+	}
+
+	rsp, ok := u.rsps[u.key(q.Name, q.Qtype)]
+	if !ok {
+		return nil, errors.New("unexpected query " + u.key(q.Name, q.Qtype))
+	}
+
+	out := rsp.Copy()
+	out.Id = req.Id
+	out.Response = true
+	out.Question = req.Question
+	return out, nil
+}
+
+func (u *testUpstream) Addr() string {
+	return "test://upstream"
+}
+
+func newTestA(name string, ip string) *dns.A {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP(ip),
+	}
+}
+
+func newTestCNAME(name, target string) *dns.CNAME {
+	return &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+		Target: target,
+	}
+}
+
+func newTestDNAME(name, target string) *dns.DNAME {
+	return &dns.DNAME{
+		Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeDNAME, Class: dns.ClassINET, Ttl: 300},
+		Target: target,
+	}
+}
+
+func newTestNSEC(name, next string, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+func newValidateRsp(name string, rcode int, answer, ns []dns.RR) *dns.Msg {
+	rsp := new(dns.Msg)
+	rsp.SetQuestion(name, dns.TypeA)
+	rsp.Response = true
+	rsp.Rcode = rcode
+	rsp.Answer = answer
+	rsp.Ns = ns
+	return rsp
+}
+
+func TestDNSSECValidate(t *testing.T) {
+	root := newTestZone(t, ".")
+	com := newTestZone(t, "com.")
+	example := newTestZone(t, "example.com.")
+	now := time.Now()
+
+	// chain of trust: . -> com. -> example.com., insecure.com. is delegated w/o DS
+	newChain := func(t *testing.T) *testUpstream {
+		up := newTestUpstream()
+		up.set(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.signNow(t, root.key), nil)
+		up.set("com.", dns.TypeDS, dns.RcodeSuccess, root.signNow(t, com.ds()), nil)
+		up.set("com.", dns.TypeDNSKEY, dns.RcodeSuccess, com.signNow(t, com.key), nil)
+		up.set("example.com.", dns.TypeDS, dns.RcodeSuccess, com.signNow(t, example.ds()), nil)
+		up.set("example.com.", dns.TypeDNSKEY, dns.RcodeSuccess, example.signNow(t, example.key), nil)
+		up.set("insecure.com.", dns.TypeDS, dns.RcodeSuccess, nil,
+			com.signNow(t, newTestNSEC("insecure.com.", "other.com.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)),
+		)
+		up.set("www.example.com.", dns.TypeDS, dns.RcodeSuccess, nil,
+			example.signNow(t, newTestNSEC("www.example.com.", "zzz.example.com.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)),
+		)
+		return up
+	}
+
+	cases := []struct {
+		name string
+		// setup adjusts the upstream and returns the response to validate
+		setup  func(t *testing.T, up *testUpstream) *dns.Msg
+		secure bool
+		bogus  bool
+		err    bool
+	}{
+		{
+			name: "secure",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				return newValidateRsp("www.example.com.", dns.RcodeSuccess,
+					example.signNow(t, newTestA("www.example.com.", "192.0.2.1")), nil)
+			},
+			secure: true,
+		},
+		{
+			name: "insecure delegation",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				return newValidateRsp("www.insecure.com.", dns.RcodeSuccess,
+					[]dns.RR{newTestA("www.insecure.com.", "192.0.2.1")}, nil)
+			},
+		},
+		{
+			name: "secure CNAME chain",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				answer := example.signNow(t, newTestCNAME("www.example.com.", "cdn.example.com."))
+				answer = append(answer, example.signNow(t, newTestA("cdn.example.com.", "192.0.2.1"))...)
+				return newValidateRsp("www.example.com.", dns.RcodeSuccess, answer, nil)
+			},
+			secure: true,
+		},
+		{
+			name: "DNAME to insecure zone",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				answer := example.signNow(t, newTestDNAME("alias.example.com.", "insecure.com."))
+				answer = append(answer,
+					newTestCNAME("www.alias.example.com.", "www.insecure.com."),
+					newTestA("www.insecure.com.", "192.0.2.1"),
+				)
+				return newValidateRsp("www.alias.example.com.", dns.RcodeSuccess, answer, nil)
+			},
+		},
+		{
+			name: "stripped signatures",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				return newValidateRsp("www.example.com.", dns.RcodeSuccess,
+					[]dns.RR{newTestA("www.example.com.", "192.0.2.1")}, nil)
+			},
+			bogus: true,
+		},
+		{
+			name: "foreign-owner unsigned answer",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				return newValidateRsp("www.example.com.", dns.RcodeSuccess,
+					[]dns.RR{newTestA("evil.insecure.com.", "198.51.100.66")}, nil)
+			},
+			bogus: true,
+		},
+		{
+			name: "forged CNAME with unrelated DNAME",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				answer := example.signNow(t, newTestDNAME("alias.example.com.", "insecure.com."))
+				answer = append(answer,
+					newTestCNAME("www.example.com.", "evil.insecure.com."),
+					newTestA("evil.insecure.com.", "198.51.100.66"),
+				)
+				return newValidateRsp("www.example.com.", dns.RcodeSuccess, answer, nil)
+			},
+			bogus: true,
+		},
+		{
+			name: "tampered answer",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				answer := example.signNow(t, newTestA("www.example.com.", "192.0.2.1"))
+				answer[0].(*dns.A).A = net.ParseIP("198.51.100.1")
+				return newValidateRsp("www.example.com.", dns.RcodeSuccess, answer, nil)
+			},
+			bogus: true,
+		},
+		{
+			name: "expired RRSIG",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				return newValidateRsp("www.example.com.", dns.RcodeSuccess,
+					example.sign(t, now.Add(-2*time.Hour), now.Add(-time.Hour), newTestA("www.example.com.", "192.0.2.1")), nil)
+			},
+			bogus: true,
+		},
+		{
+			name: "not yet valid RRSIG",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				return newValidateRsp("www.example.com.", dns.RcodeSuccess,
+					example.sign(t, now.Add(time.Hour), now.Add(2*time.Hour), newTestA("www.example.com.", "192.0.2.1")), nil)
+			},
+			bogus: true,
+		},
+		{
+			name: "bad DS digest",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				ds := example.ds()
+				ds.Digest = strings.Repeat("00", len(ds.Digest)/2)
+				up.set("example.com.", dns.TypeDS, dns.RcodeSuccess, com.signNow(t, ds), nil)
+				return newValidateRsp("www.example.com.", dns.RcodeSuccess,
+					example.signNow(t, newTestA("www.example.com.", "192.0.2.1")), nil)
+			},
+			bogus: true,
+		},
+		{
+			name: "DNSKEY query failed",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				up.errs[up.key("example.com.", dns.TypeDNSKEY)] = errors.New("i/o timeout")
+				return newValidateRsp("www.example.com.", dns.RcodeSuccess,
+					example.signNow(t, newTestA("www.example.com.", "192.0.2.1")), nil)
+			},
+			err: true,
+		},
+		{
+			name: "DS query SERVFAIL",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				up.set("example.com.", dns.TypeDS, dns.RcodeServerFailure, nil, nil)
+				return newValidateRsp("www.example.com.", dns.RcodeSuccess,
+					example.signNow(t, newTestA("www.example.com.", "192.0.2.1")), nil)
+			},
+			err: true,
+		},
+		{
+			name: "NXDOMAIN is never secure",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				return newValidateRsp("nope.example.com.", dns.RcodeNameError, nil,
+					example.signNow(t, newTestNSEC("example.com.", "www.example.com.", dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY)))
+			},
+		},
+		{
+			name: "wildcard answer is never secure",
+			setup: func(t *testing.T, up *testUpstream) *dns.Msg {
+				answer := example.signNow(t, newTestA("*.example.com.", "192.0.2.1"))
+				for _, rr := range answer {
+					rr.Header().Name = "any.example.com."
+				}
+				return newValidateRsp("any.example.com.", dns.RcodeSuccess, answer, nil)
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			up := newChain(t)
+			rsp := tc.setup(t, up)
+
+			v := newDNSSECValidator(up, NewDNSSECConfig().WithTrustAnchors(root.ds().String()).Build())
+			defer v.Stop()
+
+			secure, err := v.Validate(context.Background(), rsp)
+			if bogus := errors.Is(err, errDNSSECBogus); bogus != tc.bogus {
+				t.Fatalf("bogus: got %t (%v), want %t", bogus, err, tc.bogus)
+			}
+
+			if !tc.bogus && (err != nil) != tc.err {
+				t.Fatalf("error: got %v, want error %t", err, tc.err)
+			}
+
+			if secure != tc.secure {
+				t.Fatalf("secure: got %t, want %t", secure, tc.secure)
+			}
+		})
+	}
+}
+
+func TestDNSSECLocalZone(t *testing.T) {
+	root := newTestZone(t, ".")
+	up := newTestUpstream()
+	up.set(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.signNow(t, root.key), nil)
+	// neither the office resolver nor the forged answer have the DS denial proof
+	up.set("corp.", dns.TypeDS, dns.RcodeNameError, nil, nil)
+	up.set("example.", dns.TypeDS, dns.RcodeSuccess, nil, nil)
+	up.set("host.corp.", dns.TypeA, dns.RcodeSuccess, []dns.RR{newTestA("host.corp.", "10.0.0.1")}, nil)
+	up.set("host.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{newTestA("host.example.", "10.0.0.1")}, nil)
+
+	clientCfg := NewClientConfig().
+		WithRoutes(
+			NewRouteConfig().WithDomains(".corp").WithAddrs("udp://10.0.0.53:53").WithLocalZone(true).Build(),
+			NewRouteConfig().WithDomains(".example").WithAddrs("tcp://9.9.9.9:53").Build(),
+		).
+		Build()
+
+	dnssec := newDNSSECValidator(up, NewDNSSECConfig().WithTrustAnchors(root.ds().String()).Build())
+	defer dnssec.Stop()
+
+	srv := &Server{
+		upstream:   up,
+		localZones: clientCfg.localZones(),
+		dnssec:     dnssec,
+		ctx:        context.Background(),
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("host.corp.", dns.TypeA)
+	req.SetEdns0(DefaultEDNSBufSize, false)
+	rsp, err := srv.exchange(context.Background(), req)
+	if err != nil {
+		t.Fatalf("local zone: unexpected error: %v", err)
+	}
+
+	if len(rsp.Answer) != 1 || rsp.AuthenticatedData {
+		t.Fatalf("local zone: unexpected response: %s", rsp)
+	}
+
+	req.SetQuestion("host.example.", dns.TypeA)
+	if _, err := srv.exchange(context.Background(), req); !errors.Is(err, errDNSSECBogus) {
+		t.Fatalf("routed zone: got %v, want %v", err, errDNSSECBogus)
+	}
+}
@@ -3,14 +3,20 @@ package dnssrv
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/buglloc/certifi"
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/buglloc/deblocker/internal/domains"
 )
 
 const (
@@ -18,12 +24,28 @@ const (
 	minimumTTL = 90
 )
 
+type listener interface {
+	ListenAndServe() error
+	Shutdown() error
+}
+
 type Server struct {
-	upstream      string
+	upstream      Upstream
+	ecs           ecsPolicy
+	localZones    []string
 	handler       IPHandler
 	handleFilters []handleFilter
 	srvCfg        *ServerConfig
-	dnsc          *dns.Client
+	tlsCfg        *tls.Config
+	cache         *respCache
+	local         *localResolver
+	queryLog      *queryLogger
+	rateLimiter   *rateLimiter
+	prefetcher    *prefetcher
+	dnssec        *dnssecValidator
+	dohBypass     *dohBypass
+	onTampered    TamperHandler
+	flights       singleflight.Group
 	closed        chan struct{}
 	ctx           context.Context
 	shutdownFn    context.CancelFunc
@@ -38,29 +60,97 @@ func NewServer(srvCfg *ServerConfig, clientCfg *ClientConfig) (*Server, error) {
 		return nil, fmt.Errorf("invalid client configuration: %w", err)
 	}
 
+	tlsCfg, err := srvCfg.newTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid server TLS configuration: %w", err)
+	}
+
+	upstream, err := clientCfg.newUpstream()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create upstream: %w", err)
+	}
+
+	var cache *respCache
+	if srvCfg.cache != nil && srvCfg.cache.size > 0 {
+		cache = newRespCache(srvCfg.cache)
+	}
+
+	var local *localResolver
+	if srvCfg.local != nil && !srvCfg.local.isEmpty() {
+		local, err = newLocalResolver(srvCfg.local)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create local resolver: %w", err)
+		}
+	}
+
+	var queryLog *queryLogger
+	if srvCfg.queryLog != nil && srvCfg.queryLog.path != "" {
+		queryLog, err = newQueryLogger(srvCfg.queryLog)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create query log: %w", err)
+		}
+	}
+
+	var limiter *rateLimiter
+	if srvCfg.rateLimit != nil && srvCfg.rateLimit.qps > 0 {
+		limiter = newRateLimiter(srvCfg.rateLimit)
+	}
+
+	var prefetch *prefetcher
+	if srvCfg.prefetch != nil && srvCfg.prefetch.size > 0 {
+		prefetch = newPrefetcher(srvCfg.prefetch)
+	}
+
+	var dnssec *dnssecValidator
+	if srvCfg.dnssec != nil {
+		dnssec = newDNSSECValidator(upstream, srvCfg.dnssec)
+	}
+
+	var bypass *dohBypass
+	if srvCfg.dohBypass != nil {
+		bypass = newDoHBypass(srvCfg.dohBypass)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
-		upstream:      clientCfg.addr,
+		upstream:      upstream,
+		ecs:           clientCfg.ecs,
+		localZones:    clientCfg.localZones(),
 		handler:       srvCfg.handler,
 		handleFilters: srvCfg.handleFilters,
 		srvCfg:        srvCfg,
-		dnsc: &dns.Client{
-			Net: clientCfg.net,
-			TLSConfig: &tls.Config{
-				RootCAs: certifi.NewCertPool(),
-			},
-			DialTimeout:  clientCfg.dialTimeout,
-			ReadTimeout:  clientCfg.readTimeout,
-			WriteTimeout: clientCfg.writeTimeout,
-		},
-		closed:     make(chan struct{}),
-		ctx:        ctx,
-		shutdownFn: cancel,
+		tlsCfg:        tlsCfg,
+		cache:         cache,
+		local:         local,
+		queryLog:      queryLog,
+		rateLimiter:   limiter,
+		prefetcher:    prefetch,
+		dnssec:        dnssec,
+		dohBypass:     bypass,
+		onTampered:    srvCfg.onTampered,
+		closed:        make(chan struct{}),
+		ctx:           ctx,
+		shutdownFn:    cancel,
 	}, nil
 }
 
 func (s *Server) ListenAndServe() error {
 	defer close(s.closed)
+	if s.cache != nil {
+		defer s.cache.Stop()
+	}
+
+	if s.queryLog != nil {
+		defer func() { _ = s.queryLog.Close() }()
+	}
+
+	if s.rateLimiter != nil {
+		defer s.rateLimiter.Stop()
+	}
+
+	if s.dnssec != nil {
+		defer s.dnssec.Stop()
+	}
 
 	g, ctx := errgroup.WithContext(s.ctx)
 	shutdownFuncs := make([]func() error, len(s.srvCfg.addrs))
@@ -69,20 +159,41 @@ func (s *Server) ListenAndServe() error {
 		addr := addr
 
 		g.Go(func() error {
-			srv := s.newServer(addr)
+			srv, err := s.newListener(addr)
+			if err != nil {
+				return fmt.Errorf("unable to create listener %q: %w", addr, err)
+			}
 			shutdownFuncs[i] = srv.Shutdown
 
 			log.Info().
-				Str("net", srv.Net).
-				Str("addr", srv.Addr).
+				Str("net", addr.Scheme).
+				Str("addr", addr.Host).
 				Msg("start DNS listening")
 			return srv.ListenAndServe()
 		})
 	}
 
+	if s.local != nil {
+		g.Go(func() error {
+			s.local.Watch(ctx.Done())
+			return nil
+		})
+	}
+
+	if s.prefetcher != nil {
+		g.Go(func() error {
+			s.prefetchWorker(ctx.Done())
+			return nil
+		})
+	}
+
 	g.Go(func() error {
 		<-ctx.Done()
 		for _, fn := range shutdownFuncs {
+			if fn == nil {
+				continue
+			}
+
 			if err := fn(); err != nil {
 				log.Warn().Err(err).Msg("shutdown failed")
 			}
@@ -105,34 +216,323 @@ func (s *Server) Shutdown(ctx context.Context) error {
 }
 
 func (s *Server) srvHandler(w dns.ResponseWriter, r *dns.Msg) {
-	rsp, _, err := s.dnsc.Exchange(r, s.upstream)
+	startedAt := time.Now()
+	ctx, trace := withUpstreamTrace(s.ctx)
+
+	rsp, handled := s.serve(ctx, r, w.RemoteAddr())
+	if rsp != nil {
+		_ = w.WriteMsg(rsp)
+	}
+
+	if s.queryLog != nil {
+		s.queryLog.Log(queryLogEntry{
+			startedAt: startedAt,
+			clientIP:  clientIP(w.RemoteAddr()),
+			req:       r,
+			rsp:       rsp,
+			upstream:  trace.addr,
+			handled:   handled,
+		})
+	}
+}
+
+func (s *Server) serve(ctx context.Context, r *dns.Msg, remoteAddr net.Addr) (*dns.Msg, []handledRR) {
+	if !s.isClientAllowed(clientIP(remoteAddr)) {
+		log.Debug().
+			Str("client", remoteAddr.String()).
+			Msg("client is not allowed, refuse request")
+		return errorResponse(r, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited), nil
+	}
+
+	if s.rateLimiter != nil && !s.rateLimiter.Allow(clientIP(remoteAddr)) {
+		log.Debug().
+			Str("client", remoteAddr.String()).
+			Str("action", s.rateLimiter.action.String()).
+			Msg("client is rate limited")
+		return rateLimitedResponse(r, remoteAddr, s.rateLimiter.action), nil
+	}
+
+	if s.dohBypass != nil {
+		if rsp, ok := s.dohBypass.Answer(r); ok {
+			log.Debug().
+				Str("client", remoteAddr.String()).
+				Str("req", r.Question[0].String()).
+				Msg("DoH bypass attempt blocked")
+			traceUpstream(ctx, "doh_bypass")
+			return clientResponse(r, rsp, remoteAddr), nil
+		}
+	}
+
+	if s.local != nil {
+		if rsp, ok := s.localAnswer(ctx, r); ok {
+			var handled []handledRR
+			if s.local.observable {
+				handled = s.processHandler(rsp, r, clientIP(remoteAddr))
+			}
+
+			s.postProcess(r, rsp)
+			return clientResponse(r, rsp, remoteAddr), handled
+		}
+	}
+
+	upstreamReq := s.upstreamRequest(r)
+	rsp, handled, err := s.resolveShared(ctx, upstreamReq, clientIP(remoteAddr))
 	if err != nil {
 		log.Error().
+			Str("upstream", s.upstream.Addr()).
 			Str("req", r.String()).
 			Err(err).
 			Msg("request failed")
-		_ = w.Close()
+		return servfailResponse(r, err), nil
+	}
+
+	if s.prefetcher != nil {
+		s.prefetcher.Track(upstreamReq, rsp, clientIP(remoteAddr))
+	}
+
+	s.postProcess(r, rsp)
+	return clientResponse(r, rsp, remoteAddr), handled
+}
+
+// postProcess hides the upstream request details (ECS, DNSSEC records) from the client
+func (s *Server) postProcess(r, rsp *dns.Msg) {
+	s.ecs.clientResponse(rsp)
+	if s.dnssec != nil {
+		dnssecClientResponse(r, rsp)
+	}
+}
+
+// upstreamRequest prepares the client request to be sent upstream, applying the ECS policy
+func (s *Server) upstreamRequest(r *dns.Msg) *dns.Msg {
+	out := upstreamRequest(r)
+
+	var vpn bool
+	if s.ecs.mode == ECSModeFixed && s.srvCfg.routingLookup != nil && len(out.Question) > 0 {
+		vpn = s.srvCfg.routingLookup(out.Question[0].Name, nil).VPN
+	}
+
+	s.ecs.apply(out, vpn)
+	return out
+}
+
+type flightResult struct {
+	rsp      *dns.Msg
+	handled  []handledRR
+	upstream string
+}
+
+// resolveShared coalesces identical in-flight requests: the upstream answer and the handler verdicts
+// are shared by all the waiters, so the handler is called once per answer
+func (s *Server) resolveShared(ctx context.Context, r *dns.Msg, clientIP net.IP) (*dns.Msg, []handledRR, error) {
+	key, ok := cacheKey(r)
+	if !ok {
+		rsp, err := s.resolve(ctx, r)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		handled := s.processHandler(rsp, r, clientIP)
+		s.stripUnroutedIPv6(rsp, r)
+		return rsp, handled, nil
+	}
+
+	// handler filters depend on the client, so don't mix observable clients with others
+	key = fmt.Sprintf("%s:%t", key, s.isObservableClient(clientIP))
+	v, err, _ := s.flights.Do(key, func() (interface{}, error) {
+		flightCtx, trace := withUpstreamTrace(ctx)
+		rsp, err := s.resolve(flightCtx, r)
+		if err != nil {
+			return nil, err
+		}
+
+		handled := s.processHandler(rsp, r, clientIP)
+		s.stripUnroutedIPv6(rsp, r)
+		return flightResult{
+			rsp:      rsp,
+			handled:  handled,
+			upstream: trace.addr,
+		}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := v.(flightResult)
+	traceUpstream(ctx, res.upstream)
+
+	// the response is modified for every client, so each waiter gets its own copy
+	rsp := res.rsp.Copy()
+	rsp.Question = r.Question
+	return rsp, res.handled, nil
+}
+
+func (s *Server) localAnswer(ctx context.Context, r *dns.Msg) (*dns.Msg, bool) {
+	rsp, cnameTarget := s.local.Answer(r)
+	if rsp == nil {
+		return nil, false
+	}
+
+	traceUpstream(ctx, "local")
+	if cnameTarget == "" {
+		return rsp, true
+	}
+
+	targetReq := r.Copy()
+	targetReq.Question[0].Name = cnameTarget
+	targetRsp, err := s.resolve(ctx, s.upstreamRequest(targetReq))
+	if err != nil {
+		log.Error().
+			Str("upstream", s.upstream.Addr()).
+			Str("req", targetReq.String()).
+			Err(err).
+			Msg("local CNAME target request failed")
+		return servfailResponse(r, err), true
+	}
+
+	rsp.Rcode = targetRsp.Rcode
+	rsp.Answer = append(rsp.Answer, targetRsp.Answer...)
+	return rsp, true
+}
+
+// resolve resolves the upstream request (see upstreamRequest) using the cache if any
+func (s *Server) resolve(ctx context.Context, r *dns.Msg) (*dns.Msg, error) {
+	if s.cache == nil {
+		return s.exchange(ctx, r)
+	}
+
+	if rsp := s.cache.Get(r); rsp != nil {
+		traceUpstream(ctx, "cache")
+		return rsp, nil
+	}
+
+	rsp, err := s.exchange(ctx, r)
+	// the stale answer could be the tampered one as well
+	if errors.Is(err, errDNSSECBogus) {
+		return nil, err
+	}
+
+	// RFC 8767: the stale answer is better than the upstream failure, either the transport or the SERVFAIL/REFUSED one
+	failure := err
+	if err == nil && (rsp.Rcode == dns.RcodeServerFailure || rsp.Rcode == dns.RcodeRefused) {
+		failure = fmt.Errorf("upstream answered %s", dns.RcodeToString[rsp.Rcode])
+	}
+
+	if failure != nil {
+		if stale := s.cache.GetStale(r); stale != nil {
+			log.Warn().
+				Str("upstream", s.upstream.Addr()).
+				Str("req", r.Question[0].String()).
+				Err(failure).
+				Msg("request failed, serve stale response")
+			traceUpstream(ctx, "stale_cache")
+			return stale, nil
+		}
+
+		return rsp, err
+	}
+
+	s.cache.Set(r, rsp)
+	return rsp, nil
+}
+
+// exchange sends the request upstream and validates the response if DNSSEC validation is enabled.
+// Clients asking with CD are trusted to validate on their own (RFC 4035, section 3.2.2).
+func (s *Server) exchange(ctx context.Context, r *dns.Msg) (*dns.Msg, error) {
+	// local zones are unsigned and aren't delegated from the root
+	if s.dnssec == nil || r.CheckingDisabled || s.isLocalZone(r) {
+		return s.upstream.Exchange(ctx, r)
+	}
+
+	req := r.Copy()
+	req.IsEdns0().SetDo()
+	req.CheckingDisabled = true
+
+	rsp, err := s.upstream.Exchange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// chain of trust queries must not overwrite the upstream trace of the request
+	secure, err := s.dnssec.Validate(s.ctx, rsp)
+	if err != nil {
+		if errors.Is(err, errDNSSECBogus) && s.onTampered != nil && len(r.Question) > 0 {
+			s.onTampered(r.Question[0].Name)
+		}
+
+		return nil, err
+	}
+
+	rsp.AuthenticatedData = secure
+	rsp.CheckingDisabled = false
+	return rsp, nil
+}
+
+// prefetchWorker refreshes popular answers before they expire, so the handler sees the rotated IPs in advance.
+// It returns once the running prefetches are done, so Shutdown never returns while they are calling the handler
+func (s *Server) prefetchWorker(done <-chan struct{}) {
+	ticker := time.NewTicker(prefetchCheckPeriod)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	sem := make(chan struct{}, prefetchConcurrency)
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			for _, entry := range s.prefetcher.Due(now) {
+				select {
+				case <-done:
+					return
+				case sem <- struct{}{}:
+				}
+
+				wg.Add(1)
+				go func(entry *prefetchEntry) {
+					defer wg.Done()
+					defer func() { <-sem }()
+
+					s.prefetch(entry)
+				}(entry)
+			}
+		}
+	}
+}
+
+func (s *Server) prefetch(entry *prefetchEntry) {
+	rsp, err := s.exchange(s.ctx, entry.req)
+	if err != nil {
+		log.Debug().
+			Str("upstream", s.upstream.Addr()).
+			Str("req", entry.req.Question[0].String()).
+			Err(err).
+			Msg("prefetch failed")
 		return
 	}
 
-	s.processHandler(rsp, r, clientIP(w.RemoteAddr()))
+	if s.cache != nil {
+		s.cache.Set(entry.req, rsp)
+	}
 
-	_ = w.WriteMsg(rsp)
+	s.processHandler(rsp, entry.req, entry.clientIP)
+	s.prefetcher.Reschedule(entry.req, rsp, entry.clientIP)
 }
 
-func (s *Server) processHandler(rsp, req *dns.Msg, clientIP net.IP) {
+func (s *Server) processHandler(rsp, req *dns.Msg, clientIP net.IP) []handledRR {
 	if s.handler == nil {
-		return
+		return nil
 	}
 
-	if req.Opcode != dns.OpcodeQuery {
-		return
+	if req.Opcode != dns.OpcodeQuery || s.isLocalZone(req) {
+		return nil
 	}
 
 	var fqdn string
 	for _, rr := range req.Question {
 		switch rr.Qtype {
-		case dns.TypeAAAA, dns.TypeA:
+		case dns.TypeAAAA, dns.TypeA, dns.TypeHTTPS, dns.TypeSVCB:
 		default:
 			continue
 		}
@@ -141,33 +541,128 @@ func (s *Server) processHandler(rsp, req *dns.Msg, clientIP net.IP) {
 		break
 	}
 
+	var toHandle []RR
+	chain := cnameChain(fqdn, rsp.Answer)
 	for _, rr := range rsp.Answer {
 		ttl := rr.Header().Ttl
 		if ttl < minimumTTL {
 			ttl = minimumTTL
 		}
 
-		handlerRR := RR{
-			FQDN: fqdn,
-			TTL:  ttl,
+		for _, handlerRR := range answerIPs(rr) {
+			handlerRR.FQDN = fqdn
+			handlerRR.Chain = chainTo(chain, rr.Header().Name)
+			handlerRR.TTL = ttl
+
+			if !s.checkHandlerConditions(handlerRR, clientIP) {
+				continue
+			}
+
+			toHandle = append(toHandle, handlerRR)
+		}
+	}
+
+	verdicts := make([]Verdict, len(toHandle))
+	if s.srvCfg.handleTimeout <= 0 {
+		for i, rr := range toHandle {
+			verdicts[i] = s.handler(s.ctx, rr)
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(s.ctx, s.srvCfg.handleTimeout)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		wg.Add(len(toHandle))
+		for i, rr := range toHandle {
+			go func(i int, rr RR) {
+				defer wg.Done()
+
+				verdicts[i] = s.handler(ctx, rr)
+			}(i, rr)
+		}
+		wg.Wait()
+	}
+
+	limitAnswerTTL(rsp, verdicts)
+
+	out := make([]handledRR, len(toHandle))
+	for i, rr := range toHandle {
+		out[i] = handledRR{
+			rr:      rr,
+			verdict: verdicts[i],
 		}
+	}
+	return out
+}
+
+// stripUnroutedIPv6 removes AAAA records and ipv6hint of the VPN sites if IPv6 can't be routed,
+// otherwise dual-stack clients would connect over IPv6 and hit the block anyway
+func (s *Server) stripUnroutedIPv6(rsp, req *dns.Msg) {
+	if s.srvCfg.routingLookup == nil || len(req.Question) == 0 || !hasIPv6Answers(rsp) {
+		return
+	}
+
+	fqdn := req.Question[0].Name
+	routing := s.srvCfg.routingLookup(fqdn, cnameChain(fqdn, rsp.Answer))
+	if !routing.VPN || (routing.IPv6 && s.isIPv6Observable()) {
+		return
+	}
+
+	answer := rsp.Answer[:0]
+	for _, rr := range rsp.Answer {
 		switch v := rr.(type) {
-		case *dns.A:
-			handlerRR.Kind = IPKindV4
-			handlerRR.IP = v.A
 		case *dns.AAAA:
-			handlerRR.Kind = IPKindV6
-			handlerRR.IP = v.AAAA
-		default:
 			continue
+		case *dns.RRSIG:
+			if v.TypeCovered == dns.TypeAAAA {
+				continue
+			}
+		case *dns.HTTPS:
+			v.Value = withoutIPv6Hint(v.Value)
+		case *dns.SVCB:
+			v.Value = withoutIPv6Hint(v.Value)
 		}
 
-		if !s.checkHandlerConditions(handlerRR, clientIP) {
-			continue
-		}
+		answer = append(answer, rr)
+	}
 
-		s.handler(handlerRR)
+	log.Debug().
+		Str("fqdn", fqdn).
+		Bool("ipv6_exported", routing.IPv6).
+		Msg("strip unrouted IPv6 answers")
+	rsp.Answer = answer
+}
+
+// isLocalZone reports whether the request is for one of the routes' local zones: those are neither validated nor passed to the handler
+func (s *Server) isLocalZone(req *dns.Msg) bool {
+	if len(s.localZones) == 0 || len(req.Question) == 0 {
+		return false
+	}
+
+	return domains.Match(s.localZones, req.Question[0].Name) >= 0
+}
+
+// isIPv6Observable reports whether IPv6 addresses are passed to the handler, so they could be routed at all
+func (s *Server) isIPv6Observable() bool {
+	if len(s.srvCfg.observedKinds) == 0 {
+		return true
 	}
+
+	_, ok := s.srvCfg.observedKinds[IPKindV6]
+	return ok
+}
+
+// isObservableClient reports whether answers for the client may be passed to the handler at all
+func (s *Server) isObservableClient(ip net.IP) bool {
+	return len(s.srvCfg.observedNets) == 0 || containsIP(s.srvCfg.observedNets, ip)
+}
+
+func (s *Server) isClientAllowed(ip net.IP) bool {
+	if containsIP(s.srvCfg.deniedNets, ip) {
+		return false
+	}
+
+	return len(s.srvCfg.allowedNets) == 0 || containsIP(s.srvCfg.allowedNets, ip)
 }
 
 func (s *Server) checkHandlerConditions(rr RR, clientIP net.IP) bool {
@@ -180,15 +675,67 @@ func (s *Server) checkHandlerConditions(rr RR, clientIP net.IP) bool {
 	return true
 }
 
-func (s *Server) newServer(addr *url.URL) *dns.Server {
-	return &dns.Server{
-		Net:           addr.Scheme,
-		Addr:          addr.Host,
-		Handler:       dns.HandlerFunc(s.srvHandler),
-		MaxTCPQueries: s.srvCfg.maxTCPQueries,
-		ReadTimeout:   s.srvCfg.readTimeout,
-		WriteTimeout:  s.srvCfg.writeTimeout,
+func (s *Server) newListener(addr *url.URL) (listener, error) {
+	switch addr.Scheme {
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		return &dns.Server{
+			Net:           addr.Scheme,
+			Addr:          addr.Host,
+			Handler:       dns.HandlerFunc(s.srvHandler),
+			MaxTCPQueries: s.srvCfg.maxTCPQueries,
+			ReadTimeout:   s.srvCfg.readTimeout,
+			WriteTimeout:  s.srvCfg.writeTimeout,
+		}, nil
+	case "tls":
+		if s.tlsCfg == nil {
+			return nil, errors.New("TLS certificate is not configured")
+		}
+
+		return &dns.Server{
+			Net:           "tcp-tls",
+			Addr:          hostWithDefaultPort(addr, "853"),
+			TLSConfig:     s.tlsCfg,
+			Handler:       dns.HandlerFunc(s.srvHandler),
+			MaxTCPQueries: s.srvCfg.maxTCPQueries,
+			ReadTimeout:   s.srvCfg.readTimeout,
+			WriteTimeout:  s.srvCfg.writeTimeout,
+		}, nil
+	case "https":
+		if s.tlsCfg == nil {
+			return nil, errors.New("TLS certificate is not configured")
+		}
+
+		return newDoHServer(
+			hostWithDefaultPort(addr, "443"),
+			addr.Path,
+			s.tlsCfg,
+			dns.HandlerFunc(s.srvHandler),
+			s.srvCfg.readTimeout,
+			s.srvCfg.writeTimeout,
+		), nil
+	case "quic":
+		if s.tlsCfg == nil {
+			return nil, errors.New("TLS certificate is not configured")
+		}
+
+		return newDoQServer(
+			hostWithDefaultPort(addr, "853"),
+			s.tlsCfg,
+			dns.HandlerFunc(s.srvHandler),
+			s.srvCfg.readTimeout,
+			s.srvCfg.writeTimeout,
+		), nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %s", addr.Scheme)
+	}
+}
+
+func hostWithDefaultPort(addr *url.URL, port string) string {
+	if addr.Port() != "" {
+		return addr.Host
 	}
+
+	return net.JoinHostPort(addr.Hostname(), port)
 }
 
 func clientIP(addr net.Addr) net.IP {
@@ -201,3 +748,122 @@ func clientIP(addr net.Addr) net.IP {
 		return net.IPv4zero
 	}
 }
+
+// limitAnswerTTL rewrites TTLs of the answer so that clients don't cache it for longer than handlers allow,
+// e.g. longer than the route lives
+func limitAnswerTTL(rsp *dns.Msg, verdicts []Verdict) {
+	var maxTTL uint32
+	for _, v := range verdicts {
+		if v.MaxTTL == 0 {
+			continue
+		}
+
+		if maxTTL == 0 || v.MaxTTL < maxTTL {
+			maxTTL = v.MaxTTL
+		}
+	}
+
+	if maxTTL == 0 {
+		return
+	}
+
+	for _, rr := range rsp.Answer {
+		if rr.Header().Ttl > maxTTL {
+			rr.Header().Ttl = maxTTL
+		}
+	}
+}
+
+// answerIPs returns IPs from the A/AAAA records and ipv4hint/ipv6hint of the HTTPS/SVCB ones
+func answerIPs(rr dns.RR) []RR {
+	switch v := rr.(type) {
+	case *dns.A:
+		return []RR{{Kind: IPKindV4, IP: v.A}}
+	case *dns.AAAA:
+		return []RR{{Kind: IPKindV6, IP: v.AAAA}}
+	case *dns.HTTPS:
+		return svcbHintIPs(v.Value)
+	case *dns.SVCB:
+		return svcbHintIPs(v.Value)
+	default:
+		return nil
+	}
+}
+
+func hasIPv6Answers(rsp *dns.Msg) bool {
+	for _, rr := range rsp.Answer {
+		for _, ip := range answerIPs(rr) {
+			if ip.Kind == IPKindV6 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func withoutIPv6Hint(values []dns.SVCBKeyValue) []dns.SVCBKeyValue {
+	out := values[:0]
+	for _, kv := range values {
+		if kv.Key() != dns.SVCB_IPV6HINT {
+			out = append(out, kv)
+		}
+	}
+
+	return out
+}
+
+func svcbHintIPs(values []dns.SVCBKeyValue) []RR {
+	var out []RR
+	for _, kv := range values {
+		switch v := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			for _, ip := range v.Hint {
+				out = append(out, RR{Kind: IPKindV4, IP: ip})
+			}
+		case *dns.SVCBIPv6Hint:
+			for _, ip := range v.Hint {
+				out = append(out, RR{Kind: IPKindV6, IP: ip})
+			}
+		}
+	}
+
+	return out
+}
+
+// cnameChain follows CNAME records of the answer starting from the fqdn
+func cnameChain(fqdn string, answer []dns.RR) []string {
+	targets := make(map[string]string)
+	for _, rr := range answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			targets[strings.ToLower(cname.Hdr.Name)] = cname.Target
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil
+	}
+
+	out := []string{fqdn}
+	for len(out) <= len(targets) {
+		target, ok := targets[strings.ToLower(out[len(out)-1])]
+		if !ok {
+			break
+		}
+
+		out = append(out, target)
+	}
+
+	return out
+}
+
+// chainTo returns the part of the CNAME chain that leads to the name
+func chainTo(chain []string, name string) []string {
+	for i := 1; i < len(chain); i++ {
+		if strings.EqualFold(chain[i], name) {
+			return chain[:i+1]
+		}
+	}
+
+	return nil
+}
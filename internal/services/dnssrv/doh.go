@@ -0,0 +1,184 @@
+package dnssrv
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultDoHPath = "/dns-query"
+
+	dohContentType = "application/dns-message"
+)
+
+type dohServer struct {
+	path         string
+	handler      dns.Handler
+	writeTimeout time.Duration
+	httpSrv      *http.Server
+}
+
+func newDoHServer(addr, path string, tlsCfg *tls.Config, handler dns.Handler, readTimeout, writeTimeout time.Duration) *dohServer {
+	if path == "" {
+		path = DefaultDoHPath
+	}
+
+	out := &dohServer{
+		path:         path,
+		handler:      handler,
+		writeTimeout: writeTimeout,
+	}
+
+	// the handler may hold the response (see ServerConfig.WithHandleTimeout), so the write timeout
+	// is applied per response right before writing it instead of the http.Server one.
+	// The TLS config is shared with the DoT listener, but http2 appends its ALPN protocols to it in place
+	out.httpSrv = &http.Server{
+		Addr:        addr,
+		Handler:     out,
+		TLSConfig:   tlsCfg.Clone(),
+		ReadTimeout: readTimeout,
+	}
+	return out
+}
+
+func (s *dohServer) ListenAndServe() error {
+	err := s.httpSrv.ListenAndServeTLS("", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *dohServer) Shutdown() error {
+	return s.httpSrv.Shutdown(context.Background())
+}
+
+func (s *dohServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != s.path {
+		http.NotFound(w, r)
+		return
+	}
+
+	req, err := dohParseRequest(r)
+	if err != nil {
+		log.Debug().
+			Str("remote_addr", r.RemoteAddr).
+			Err(err).
+			Msg("invalid DoH request")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rw := &bufferedResponseWriter{
+		localAddr:  dohAddr(r.Context().Value(http.LocalAddrContextKey)),
+		remoteAddr: dohRemoteAddr(r.RemoteAddr),
+	}
+	s.handler.ServeDNS(rw, req)
+
+	// the query was dropped by the rate limiter, HTTP clients are told so instead of waiting for the timeout
+	if rw.rsp == nil {
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	out, err := rw.rsp.Pack()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to pack response: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dohMaxAge(rw.rsp)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	_, _ = w.Write(out)
+}
+
+func dohParseRequest(r *http.Request) (*dns.Msg, error) {
+	var buf []byte
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query().Get("dns")
+		if q == "" {
+			return nil, errors.New("no dns query param")
+		}
+
+		var err error
+		buf, err = base64.RawURLEncoding.DecodeString(q)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns query param: %w", err)
+		}
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dohContentType {
+			return nil, fmt.Errorf("unsupported content type: %s", ct)
+		}
+
+		var err error
+		buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read body: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported method: %s", r.Method)
+	}
+
+	var req dns.Msg
+	if err := req.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("unable to parse DNS message: %w", err)
+	}
+
+	return &req, nil
+}
+
+// dohMaxAge returns the smallest TTL of the response as recommended by RFC 8484, section 5.1
+func dohMaxAge(rsp *dns.Msg) uint32 {
+	var minTTL uint32
+	first := true
+	for _, section := range [][]dns.RR{rsp.Answer, rsp.Ns, rsp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if first || rr.Header().Ttl < minTTL {
+				minTTL = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+
+	return minTTL
+}
+
+func dohRemoteAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &net.TCPAddr{IP: net.IPv4zero}
+	}
+
+	portNum, _ := strconv.Atoi(port)
+	return &net.TCPAddr{
+		IP:   net.ParseIP(host),
+		Port: portNum,
+	}
+}
+
+func dohAddr(v any) net.Addr {
+	if addr, ok := v.(net.Addr); ok {
+		return addr
+	}
+
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
@@ -0,0 +1,319 @@
+package dnssrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoHAndDoTShareTLSConfig(t *testing.T) {
+	tlsCfg := newTestTLSConfig(t)
+	s := &Server{
+		srvCfg: NewServerConfig().Build(),
+		tlsCfg: tlsCfg,
+	}
+
+	doh, err := s.newListener(&url.URL{Scheme: "https", Host: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dot, err := s.newListener(&url.URL{Scheme: "tls", Host: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dohLn := listenTestTCP(t)
+	dohSrv := doh.(*dohServer)
+	go func() { _ = dohSrv.httpSrv.ServeTLS(dohLn, "", "") }()
+	t.Cleanup(func() { _ = dohSrv.Shutdown() })
+
+	dotLn := listenTestTCP(t)
+	dotSrv := dot.(*dns.Server)
+	dotSrv.Listener = tls.NewListener(dotLn, dotSrv.TLSConfig)
+	go func() { _ = dotSrv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = dotSrv.Shutdown() })
+
+	if proto := testTLSHandshake(t, dohLn.Addr().String(), "h2"); proto != "h2" {
+		t.Fatalf("DoH ALPN: got %q, want %q", proto, "h2")
+	}
+
+	testTLSHandshake(t, dotLn.Addr().String(), "dot")
+
+	if len(tlsCfg.NextProtos) != 0 {
+		t.Fatalf("shared TLS config was modified: %v", tlsCfg.NextProtos)
+	}
+}
+
+func TestDoHRateLimited(t *testing.T) {
+	cases := []struct {
+		name   string
+		action RateLimitAction
+		status int
+		rcode  int
+	}{
+		{name: "drop", action: RateLimitActionDrop, status: http.StatusTooManyRequests},
+		{name: "refuse", action: RateLimitActionRefuse, status: http.StatusOK, rcode: dns.RcodeRefused},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter := newRateLimiter(NewRateLimitConfig().WithQPS(0.001).WithBurst(1).WithAction(tc.action).Build())
+			defer limiter.Stop()
+
+			s := &Server{
+				srvCfg:      NewServerConfig().Build(),
+				rateLimiter: limiter,
+				ctx:         context.Background(),
+			}
+
+			// exhaust the client bucket
+			limiter.Allow(net.IPv4(127, 0, 0, 1))
+
+			buf, err := newTestReq("example.com.", dns.TypeA).Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			httpReq := httptest.NewRequest(http.MethodPost, DefaultDoHPath, bytes.NewReader(buf))
+			httpReq.Header.Set("Content-Type", dohContentType)
+			httpReq.RemoteAddr = "127.0.0.1:5353"
+
+			w := httptest.NewRecorder()
+			newDoHServer("", "", nil, dns.HandlerFunc(s.srvHandler), time.Second, time.Second).ServeHTTP(w, httpReq)
+			if w.Code != tc.status {
+				t.Fatalf("status: got %d, want %d", w.Code, tc.status)
+			}
+
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			var rsp dns.Msg
+			if err := rsp.Unpack(w.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+
+			if rsp.Rcode != tc.rcode {
+				t.Fatalf("rcode: got %s, want %s", dns.RcodeToString[rsp.Rcode], dns.RcodeToString[tc.rcode])
+			}
+		})
+	}
+}
+
+func TestTLSListenersClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	clientCert := newTestCert(t)
+	certFile, keyFile := writeTestCert(t, dir, "server", newTestCert(t))
+	caFile, _ := writeTestCert(t, dir, "client", clientCert)
+
+	srvCfg := NewServerConfig().
+		WithTLSCert(certFile, keyFile).
+		WithTLSClientCA(caFile).
+		WithDoHBypass(NewDoHBypassConfig().WithCanary(true).Build()).
+		Build()
+	tlsCfg, err := srvCfg.newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the canary is answered w/o upstream, so any query reaching the handler gets NXDOMAIN
+	s := &Server{
+		srvCfg:    srvCfg,
+		tlsCfg:    tlsCfg,
+		dohBypass: newDoHBypass(srvCfg.dohBypass),
+		ctx:       context.Background(),
+	}
+
+	opts := upstreamOpts{
+		dialTimeout:  time.Second,
+		readTimeout:  time.Second,
+		writeTimeout: time.Second,
+	}
+
+	newClients := map[string]func(clientTLS *tls.Config) Upstream{
+		"tls": func(clientTLS *tls.Config) Upstream {
+			return newPlainUpstream("tcp-tls", startTestDoT(t, s), clientTLS, opts)
+		},
+		"https": func(clientTLS *tls.Config) Upstream {
+			return newDoHUpstream(&url.URL{Scheme: "https", Host: startTestDoH(t, s)}, clientTLS, opts)
+		},
+		"quic": func(clientTLS *tls.Config) Upstream {
+			return newDoQUpstream(startTestDoQ(t, s), clientTLS, opts)
+		},
+	}
+
+	for scheme, newClient := range newClients {
+		for _, withCert := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/client_cert=%t", scheme, withCert), func(t *testing.T) {
+				clientTLS := &tls.Config{InsecureSkipVerify: true}
+				if withCert {
+					clientTLS.Certificates = []tls.Certificate{clientCert}
+				}
+
+				rsp, err := newClient(clientTLS).Exchange(context.Background(), newTestReq(dohCanaryDomain+".", dns.TypeA))
+				if !withCert {
+					if err == nil {
+						t.Fatal("expected error w/o client certificate")
+					}
+					return
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if rsp.Rcode != dns.RcodeNameError {
+					t.Fatalf("rcode: got %s, want %s", dns.RcodeToString[rsp.Rcode], dns.RcodeToString[dns.RcodeNameError])
+				}
+			})
+		}
+	}
+}
+
+func newTestCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeTestCert writes the certificate and its key as PEM files, returns their paths
+func writeTestCert(t *testing.T, dir, name string, cert tls.Certificate) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{newTestCert(t)},
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+func startTestDoT(t *testing.T, s *Server) string {
+	l, err := s.newListener(&url.URL{Scheme: "tls", Host: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln := listenTestTCP(t)
+	srv := l.(*dns.Server)
+	srv.Listener = tls.NewListener(ln, srv.TLSConfig)
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return ln.Addr().String()
+}
+
+func startTestDoH(t *testing.T, s *Server) string {
+	l, err := s.newListener(&url.URL{Scheme: "https", Host: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln := listenTestTCP(t)
+	srv := l.(*dohServer)
+	go func() { _ = srv.httpSrv.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return ln.Addr().String()
+}
+
+func startTestDoQ(t *testing.T, s *Server) string {
+	l, err := s.newListener(&url.URL{Scheme: "quic", Host: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := l.(*doqServer)
+	go func() { _ = srv.ListenAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		srv.mu.Lock()
+		tr := srv.tr
+		srv.mu.Unlock()
+		if tr != nil {
+			return tr.Conn.LocalAddr().String()
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatal("DoQ server didn't start")
+	return ""
+}
+
+func listenTestTCP(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ln
+}
+
+// testTLSHandshake connects to the addr offering the ALPN protocol and returns the negotiated one
+func testTLSHandshake(t *testing.T, addr, proto string) string {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{proto},
+	})
+	if err != nil {
+		t.Fatalf("%s handshake: %v", proto, err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	return conn.ConnectionState().NegotiatedProtocol
+}
@@ -0,0 +1,95 @@
+package dnssrv
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+
+	"github.com/buglloc/deblocker/internal/domains"
+)
+
+const (
+	// Firefox disables the default DoH if this name doesn't resolve
+	dohCanaryDomain = "use-application-dns.net"
+	dohSinkholeTTL  = 300
+)
+
+// DefaultDoHBypassDomains are the well-known public DoH/DoT endpoints the browsers and OSes switch to.
+// Those are the hostnames of the public encrypted upstreams as well, so they can't be resolved by the clients
+var DefaultDoHBypassDomains = []string{
+	"dns.google",
+	"dns.google.com",
+	"cloudflare-dns.com",
+	"one.one.one.one",
+	"dns.quad9.net",
+	"dns9.quad9.net",
+	"dns10.quad9.net",
+	"dns11.quad9.net",
+	"doh.opendns.com",
+	"dns.adguard.com",
+	"dns.adguard-dns.com",
+	"dns.nextdns.io",
+	"doh.cleanbrowsing.org",
+	"doh.mullvad.net",
+	"dns.mullvad.net",
+	"freedns.controld.com",
+	"doh.dns.sb",
+}
+
+var dohCanaryDomains = domains.Normalize([]string{dohCanaryDomain})
+
+// dohBypass keeps clients on our resolver: answers the Firefox canary with NXDOMAIN and refuses (or sinkholes)
+// the public DoH/DoT endpoints, so the clients fall back to the system resolver
+type dohBypass struct {
+	canary  bool
+	domains []string
+	action  DoHBypassAction
+}
+
+func newDoHBypass(cfg *DoHBypassConfig) *dohBypass {
+	return &dohBypass{
+		canary:  cfg.canary,
+		domains: domains.Normalize(cfg.domains),
+		action:  cfg.action,
+	}
+}
+
+// Answer returns the synthesized response if the request must not be resolved
+func (b *dohBypass) Answer(req *dns.Msg) (*dns.Msg, bool) {
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) == 0 {
+		return nil, false
+	}
+
+	q := req.Question[0]
+	if b.canary && domains.Match(dohCanaryDomains, q.Name) >= 0 {
+		return errorResponse(req, dns.RcodeNameError, dns.ExtendedErrorCodeBlocked), true
+	}
+
+	if domains.Match(b.domains, q.Name) < 0 {
+		return nil, false
+	}
+
+	if b.action == DoHBypassActionRefuse {
+		return errorResponse(req, dns.RcodeRefused, dns.ExtendedErrorCodeBlocked), true
+	}
+
+	out := new(dns.Msg)
+	out.SetReply(req)
+	out.RecursionAvailable = true
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    dohSinkholeTTL,
+	}
+
+	// other types (e.g. HTTPS with the endpoint hints) are answered with NODATA
+	switch q.Qtype {
+	case dns.TypeA:
+		out.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+	case dns.TypeAAAA:
+		out.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+	}
+
+	return out, true
+}
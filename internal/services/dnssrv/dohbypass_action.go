@@ -0,0 +1,73 @@
+package dnssrv
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+var _ yaml.Unmarshaler = (*DoHBypassAction)(nil)
+var _ yaml.Marshaler = (*DoHBypassAction)(nil)
+var _ json.Unmarshaler = (*DoHBypassAction)(nil)
+var _ json.Marshaler = (*DoHBypassAction)(nil)
+
+type DoHBypassAction uint8
+
+const (
+	DoHBypassActionRefuse DoHBypassAction = iota
+	DoHBypassActionSinkhole
+)
+
+func (s DoHBypassAction) String() string {
+	switch s {
+	case DoHBypassActionRefuse:
+		return "refuse"
+	case DoHBypassActionSinkhole:
+		return "sinkhole"
+	default:
+		return fmt.Sprintf("unknown_%d", uint8(s))
+	}
+}
+
+func (s *DoHBypassAction) fromString(in string) error {
+	switch in {
+	case "", "refuse":
+		*s = DoHBypassActionRefuse
+	case "sinkhole":
+		*s = DoHBypassActionSinkhole
+	default:
+		return fmt.Errorf("unknown DoH bypass action: %s", in)
+	}
+	return nil
+}
+
+func (s DoHBypassAction) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+func (s *DoHBypassAction) UnmarshalYAML(val *yaml.Node) error {
+	var in string
+	if err := val.Decode(&in); err != nil {
+		return err
+	}
+
+	return s.fromString(in)
+}
+
+func (s DoHBypassAction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *DoHBypassAction) UnmarshalJSON(in []byte) error {
+	var str string
+	if err := json.Unmarshal(in, &str); err != nil {
+		return err
+	}
+
+	return s.fromString(str)
+}
+
+func (s *DoHBypassAction) UnmarshalText(in []byte) error {
+	return s.fromString(string(in))
+}
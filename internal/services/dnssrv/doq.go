@@ -0,0 +1,228 @@
+package dnssrv
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// RFC 9250, section 4.3: DOQ_PROTOCOL_ERROR
+	doqProtocolError = 0x2
+	// RFC 9250, section 5.5: servers should keep idle connections open for a while, the clients reuse them
+	doqIdleTimeout = 30 * time.Second
+)
+
+// doqServer serves DNS-over-QUIC (RFC 9250)
+type doqServer struct {
+	addr         string
+	tlsCfg       *tls.Config
+	quicCfg      *quic.Config
+	handler      dns.Handler
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	mu           sync.Mutex
+	tr           *quic.Transport
+	ln           *quic.Listener
+	conns        map[quic.Connection]struct{}
+	closed       bool
+}
+
+func newDoQServer(addr string, tlsCfg *tls.Config, handler dns.Handler, readTimeout, writeTimeout time.Duration) *doqServer {
+	tlsCfg = tlsCfg.Clone()
+	tlsCfg.NextProtos = []string{doqALPN}
+
+	return &doqServer{
+		addr:   addr,
+		tlsCfg: tlsCfg,
+		quicCfg: &quic.Config{
+			MaxIdleTimeout: doqIdleTimeout,
+		},
+		handler:      handler,
+		readTimeout:  doqTimeout(readTimeout),
+		writeTimeout: doqTimeout(writeTimeout),
+		conns:        make(map[quic.Connection]struct{}),
+	}
+}
+
+func (s *doqServer) ListenAndServe() error {
+	ln, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) || s.isClosed() {
+				return nil
+			}
+
+			return err
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *doqServer) Shutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tr == nil {
+		return errors.New("server not started")
+	}
+
+	s.closed = true
+	_ = s.ln.Close()
+	// the transport just drops the connections, so the clients must be told to not reuse them
+	for conn := range s.conns {
+		_ = conn.CloseWithError(doqNoError, "")
+	}
+
+	err := s.tr.Close()
+	_ = s.tr.Conn.Close()
+	return err
+}
+
+func (s *doqServer) listen() (*quic.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, errors.New("server closed")
+	}
+
+	pc, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &quic.Transport{
+		Conn: pc,
+	}
+	ln, err := tr.Listen(s.tlsCfg, s.quicCfg)
+	if err != nil {
+		_ = tr.Close()
+		_ = pc.Close()
+		return nil, err
+	}
+
+	s.tr = tr
+	s.ln = ln
+	return ln, nil
+}
+
+func (s *doqServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+func (s *doqServer) serveConn(conn quic.Connection) {
+	if !s.trackConn(conn) {
+		_ = conn.CloseWithError(doqNoError, "")
+		return
+	}
+	defer s.untrackConn(conn)
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			// the client has gone away or the server is shutting down
+			return
+		}
+
+		go s.serveStream(conn, stream)
+	}
+}
+
+func (s *doqServer) trackConn(conn quic.Connection) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *doqServer) untrackConn(conn quic.Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+func (s *doqServer) serveStream(conn quic.Connection, stream quic.Stream) {
+	defer func() { _ = stream.Close() }()
+
+	_ = stream.SetReadDeadline(time.Now().Add(s.readTimeout))
+	req, err := doqReadMsg(stream)
+	if err != nil {
+		log.Debug().
+			Str("remote_addr", conn.RemoteAddr().String()).
+			Err(err).
+			Msg("invalid DoQ request")
+		stream.CancelRead(doqProtocolError)
+		stream.CancelWrite(doqProtocolError)
+		return
+	}
+
+	// RFC 9250, section 4.2.1: the DNS Message ID MUST be set to 0, otherwise it's the protocol error
+	if req.Id != 0 {
+		_ = conn.CloseWithError(doqProtocolError, "non-zero message ID")
+		return
+	}
+
+	rw := &bufferedResponseWriter{
+		localAddr:  doqAddr(conn.LocalAddr()),
+		remoteAddr: doqAddr(conn.RemoteAddr()),
+	}
+	s.handler.ServeDNS(rw, req)
+
+	// the query was dropped
+	if rw.rsp == nil {
+		stream.CancelWrite(doqNoError)
+		return
+	}
+
+	rw.rsp.Id = 0
+	out, err := rw.rsp.Pack()
+	if err != nil {
+		log.Error().
+			Str("remote_addr", conn.RemoteAddr().String()).
+			Err(fmt.Errorf("unable to pack response: %w", err)).
+			Msg("DoQ response failed")
+		stream.CancelWrite(doqProtocolError)
+		return
+	}
+
+	_ = stream.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	_, _ = stream.Write(doqFrame(out))
+}
+
+// doqAddr converts the QUIC address to the TCP one: DoQ is the stream transport, so the answers must not be
+// truncated like the UDP ones
+func doqAddr(addr net.Addr) net.Addr {
+	if v, ok := addr.(*net.UDPAddr); ok {
+		return &net.TCPAddr{
+			IP:   v.IP,
+			Port: v.Port,
+			Zone: v.Zone,
+		}
+	}
+
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
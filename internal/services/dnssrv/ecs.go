@@ -0,0 +1,99 @@
+package dnssrv
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ecsPolicy decides what EDNS Client Subnet (RFC 7871) is sent upstream
+type ecsPolicy struct {
+	mode         ECSMode
+	directSubnet *net.IPNet
+	vpnSubnet    *net.IPNet
+}
+
+// apply modifies the EDNS0 upstream request according to the policy, the vpn reports whether the name is routed over VPN
+func (p ecsPolicy) apply(req *dns.Msg, vpn bool) {
+	if p.mode == ECSModePass {
+		return
+	}
+
+	opt := req.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	opt.Option = withoutECS(opt.Option)
+	if p.mode != ECSModeFixed {
+		return
+	}
+
+	subnet := p.directSubnet
+	if vpn {
+		subnet = p.vpnSubnet
+	}
+
+	if subnet == nil {
+		return
+	}
+
+	opt.Option = append(opt.Option, newECSOption(subnet))
+}
+
+// clientResponse removes ECS from the upstream response unless it was passed through from the client
+func (p ecsPolicy) clientResponse(rsp *dns.Msg) {
+	if p.mode == ECSModePass {
+		return
+	}
+
+	if opt := rsp.IsEdns0(); opt != nil {
+		opt.Option = withoutECS(opt.Option)
+	}
+}
+
+func newECSOption(subnet *net.IPNet) *dns.EDNS0_SUBNET {
+	ones, _ := subnet.Mask.Size()
+	out := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+		Address:       subnet.IP,
+	}
+
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		out.Family = 1
+		out.Address = ip4
+	} else {
+		out.Family = 2
+	}
+
+	return out
+}
+
+func withoutECS(options []dns.EDNS0) []dns.EDNS0 {
+	out := options[:0]
+	for _, o := range options {
+		if o.Option() != dns.EDNS0SUBNET {
+			out = append(out, o)
+		}
+	}
+
+	return out
+}
+
+// ecsKey returns the ECS of the request to distinguish cached responses
+func ecsKey(req *dns.Msg) string {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,78 @@
+package dnssrv
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+var _ yaml.Unmarshaler = (*ECSMode)(nil)
+var _ yaml.Marshaler = (*ECSMode)(nil)
+var _ json.Unmarshaler = (*ECSMode)(nil)
+var _ json.Marshaler = (*ECSMode)(nil)
+
+type ECSMode uint8
+
+const (
+	ECSModePass ECSMode = iota
+	ECSModeStrip
+	ECSModeFixed
+)
+
+func (m ECSMode) String() string {
+	switch m {
+	case ECSModePass:
+		return "pass"
+	case ECSModeStrip:
+		return "strip"
+	case ECSModeFixed:
+		return "fixed"
+	default:
+		return fmt.Sprintf("unknown_%d", uint8(m))
+	}
+}
+
+func (m *ECSMode) fromString(in string) error {
+	switch in {
+	case "", "pass":
+		*m = ECSModePass
+	case "strip":
+		*m = ECSModeStrip
+	case "fixed":
+		*m = ECSModeFixed
+	default:
+		return fmt.Errorf("unknown ECS mode: %s", in)
+	}
+	return nil
+}
+
+func (m ECSMode) MarshalYAML() (interface{}, error) {
+	return m.String(), nil
+}
+
+func (m *ECSMode) UnmarshalYAML(val *yaml.Node) error {
+	var in string
+	if err := val.Decode(&in); err != nil {
+		return err
+	}
+
+	return m.fromString(in)
+}
+
+func (m ECSMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+func (m *ECSMode) UnmarshalJSON(in []byte) error {
+	var str string
+	if err := json.Unmarshal(in, &str); err != nil {
+		return err
+	}
+
+	return m.fromString(str)
+}
+
+func (m *ECSMode) UnmarshalText(in []byte) error {
+	return m.fromString(string(in))
+}
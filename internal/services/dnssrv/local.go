@@ -0,0 +1,256 @@
+package dnssrv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+type localRecords map[string][]dns.RR
+
+func (r localRecords) add(rr dns.RR) {
+	name := strings.ToLower(rr.Header().Name)
+	r[name] = append(r[name], rr)
+}
+
+type hostsFile struct {
+	path    string
+	modTime time.Time
+	records localRecords
+}
+
+// localResolver answers static records and hosts files entries without going upstream
+type localResolver struct {
+	static       localRecords
+	observable   bool
+	ttl          uint32
+	reloadPeriod time.Duration
+	mu           sync.RWMutex
+	hosts        []*hostsFile
+}
+
+func newLocalResolver(cfg *LocalConfig) (*localResolver, error) {
+	out := &localResolver{
+		static:       make(localRecords),
+		observable:   cfg.observable,
+		ttl:          uint32(cfg.ttl / time.Second),
+		reloadPeriod: cfg.reloadPeriod,
+		hosts:        make([]*hostsFile, len(cfg.hostsFiles)),
+	}
+
+	for _, rec := range cfg.records {
+		rr, err := rec.toRR(cfg.ttl)
+		if err != nil {
+			return nil, err
+		}
+
+		out.static.add(rr)
+	}
+
+	for i, path := range cfg.hostsFiles {
+		out.hosts[i] = &hostsFile{
+			path: path,
+		}
+
+		// the file may appear later, the watcher picks it up
+		if err := out.reloadHosts(out.hosts[i]); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+
+			log.Warn().
+				Str("path", path).
+				Err(err).
+				Msg("hosts file doesn't exist, skip it")
+		}
+	}
+
+	return out, nil
+}
+
+// Answer returns the local answer for the request or nil if the name is unknown.
+// The unresolved CNAME target (if any) is returned as well to be resolved upstream.
+func (r *localResolver) Answer(req *dns.Msg) (*dns.Msg, string) {
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		return nil, ""
+	}
+
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil, ""
+	}
+
+	rrs := r.lookup(q.Name)
+	if len(rrs) == 0 {
+		return nil, ""
+	}
+
+	out := new(dns.Msg)
+	out.SetReply(req)
+	out.Authoritative = true
+	out.RecursionAvailable = true
+
+	seen := make(map[string]struct{})
+	for len(rrs) > 0 {
+		var cnameTarget string
+		for _, rr := range rrs {
+			switch {
+			case rr.Header().Rrtype == q.Qtype:
+				out.Answer = append(out.Answer, dns.Copy(rr))
+			case rr.Header().Rrtype == dns.TypeCNAME:
+				out.Answer = append(out.Answer, dns.Copy(rr))
+				cnameTarget = rr.(*dns.CNAME).Target
+			}
+		}
+
+		if cnameTarget == "" || q.Qtype == dns.TypeCNAME {
+			break
+		}
+
+		key := strings.ToLower(cnameTarget)
+		if _, ok := seen[key]; ok {
+			break
+		}
+		seen[key] = struct{}{}
+
+		rrs = r.lookup(cnameTarget)
+		if len(rrs) == 0 {
+			return out, cnameTarget
+		}
+	}
+
+	return out, ""
+}
+
+func (r *localResolver) Watch(done <-chan struct{}) {
+	if len(r.hosts) == 0 || r.reloadPeriod <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.reloadPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, hf := range r.hosts {
+			if err := r.reloadHosts(hf); err != nil {
+				log.Error().
+					Str("path", hf.path).
+					Err(err).
+					Msg("unable to reload hosts file")
+			}
+		}
+	}
+}
+
+func (r *localResolver) lookup(name string) []dns.RR {
+	name = strings.ToLower(name)
+	if rrs, ok := r.static[name]; ok {
+		return rrs
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, hf := range r.hosts {
+		if rrs, ok := hf.records[name]; ok {
+			return rrs
+		}
+	}
+
+	return nil
+}
+
+func (r *localResolver) reloadHosts(hf *hostsFile) error {
+	fi, err := os.Stat(hf.path)
+	if err != nil {
+		return fmt.Errorf("unable to stat hosts file %q: %w", hf.path, err)
+	}
+
+	r.mu.RLock()
+	unchanged := fi.ModTime().Equal(hf.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	records, err := parseHostsFile(hf.path, r.ttl)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	hf.modTime = fi.ModTime()
+	hf.records = records
+	r.mu.Unlock()
+
+	log.Info().
+		Str("path", hf.path).
+		Int("names", len(records)).
+		Msg("hosts file loaded")
+	return nil
+}
+
+func parseHostsFile(path string, ttl uint32) (localRecords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open hosts file %q: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	out := make(localRecords)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			hdr := dns.RR_Header{
+				Name:  dns.Fqdn(name),
+				Class: dns.ClassINET,
+				Ttl:   ttl,
+			}
+
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				out.add(&dns.A{Hdr: hdr, A: ip4})
+				continue
+			}
+
+			hdr.Rrtype = dns.TypeAAAA
+			out.add(&dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read hosts file %q: %w", path, err)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,141 @@
+package dnssrv
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// EDNS0 UDP payload size recommended by the DNS Flag Day 2020
+	DefaultEDNSBufSize = 1232
+)
+
+// upstreamRequest prepares the client request to be sent upstream: we always speak EDNS0 with our own buffer size
+func upstreamRequest(req *dns.Msg) *dns.Msg {
+	out := req.Copy()
+	if opt := out.IsEdns0(); opt != nil {
+		opt.SetUDPSize(DefaultEDNSBufSize)
+		return out
+	}
+
+	out.SetEdns0(DefaultEDNSBufSize, false)
+	return out
+}
+
+// isEDNSUnsupported reports whether the response to the EDNS0 request means that the responder doesn't support it:
+// BADVERS or FORMERR/NOTIMP w/o OPT (RFC 6891, section 7)
+func isEDNSUnsupported(req, rsp *dns.Msg) bool {
+	if req.IsEdns0() == nil {
+		return false
+	}
+
+	switch rsp.Rcode {
+	case dns.RcodeBadVers:
+		return true
+	case dns.RcodeFormatError, dns.RcodeNotImplemented:
+		return rsp.IsEdns0() == nil
+	default:
+		return false
+	}
+}
+
+// withoutEDNS returns the request copy w/o OPT record
+func withoutEDNS(req *dns.Msg) *dns.Msg {
+	out := req.Copy()
+	extra := out.Extra[:0]
+	for _, rr := range out.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	out.Extra = extra
+
+	return out
+}
+
+// clientResponse fits the upstream response to the client request: restores ID, EDNS0 presence and truncates UDP answers
+// to the client buffer size
+func clientResponse(req, rsp *dns.Msg, remoteAddr net.Addr) *dns.Msg {
+	rsp.Id = req.Id
+
+	reqOpt := req.IsEdns0()
+	rspOpt := rsp.IsEdns0()
+	switch {
+	case reqOpt == nil && rspOpt != nil:
+		extra := rsp.Extra[:0]
+		for _, rr := range rsp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		rsp.Extra = extra
+	case reqOpt != nil && rspOpt == nil:
+		rsp.SetEdns0(DefaultEDNSBufSize, reqOpt.Do())
+	case reqOpt != nil:
+		rspOpt.SetUDPSize(DefaultEDNSBufSize)
+	}
+
+	if _, isUDP := remoteAddr.(*net.UDPAddr); !isUDP {
+		return rsp
+	}
+
+	size := dns.MinMsgSize
+	if reqOpt != nil && int(reqOpt.UDPSize()) > size {
+		size = int(reqOpt.UDPSize())
+	}
+
+	rsp.Truncate(size)
+	return rsp
+}
+
+// servfailResponse synthesizes SERVFAIL with Extended DNS Error (RFC 8914) describing the upstream error
+func servfailResponse(req *dns.Msg, upstreamErr error) *dns.Msg {
+	code := dns.ExtendedErrorCodeNetworkError
+	var netErr net.Error
+	switch {
+	case errors.Is(upstreamErr, errDNSSECBogus):
+		code = dns.ExtendedErrorCodeDNSBogus
+	case errors.As(upstreamErr, &netErr) && netErr.Timeout():
+		code = dns.ExtendedErrorCodeNoReachableAuthority
+	}
+
+	return errorResponse(req, dns.RcodeServerFailure, code)
+}
+
+func errorResponse(req *dns.Msg, rcode int, edeCode uint16) *dns.Msg {
+	out := new(dns.Msg)
+	out.SetRcode(req, rcode)
+	out.RecursionAvailable = true
+
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return out
+	}
+
+	out.SetEdns0(DefaultEDNSBufSize, reqOpt.Do())
+	out.IsEdns0().Option = append(out.IsEdns0().Option, &dns.EDNS0_EDE{
+		InfoCode: edeCode,
+	})
+	return out
+}
+
+// rateLimitedResponse returns the response for the over-limit query or nil if it must be dropped.
+// Truncation forces the client to retry over TCP, so it's applicable to UDP only.
+func rateLimitedResponse(req *dns.Msg, remoteAddr net.Addr, action RateLimitAction) *dns.Msg {
+	switch action {
+	case RateLimitActionDrop:
+		return nil
+	case RateLimitActionTruncate:
+		if _, isUDP := remoteAddr.(*net.UDPAddr); isUDP {
+			out := new(dns.Msg)
+			out.SetReply(req)
+			out.RecursionAvailable = true
+			out.Truncated = true
+			return out
+		}
+	}
+
+	return errorResponse(req, dns.RcodeRefused, dns.ExtendedErrorCodeProhibited)
+}
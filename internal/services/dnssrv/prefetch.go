@@ -0,0 +1,111 @@
+package dnssrv
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	prefetchCheckPeriod = 1 * time.Second
+	// refresh the answer when this fraction of its TTL is passed
+	prefetchTTLFraction = 0.9
+	// answers with the shorter TTL are not worth it
+	prefetchMinTTL      = 10 * time.Second
+	prefetchConcurrency = 16
+)
+
+type prefetchEntry struct {
+	req       *dns.Msg
+	clientIP  net.IP
+	hits      int
+	refreshAt time.Time
+}
+
+// prefetcher tracks queries popularity and tells which answers must be refreshed before they expire
+type prefetcher struct {
+	mu      sync.Mutex
+	entries map[string]*prefetchEntry
+	size    int
+	minHits int
+}
+
+func newPrefetcher(cfg *PrefetchConfig) *prefetcher {
+	return &prefetcher{
+		entries: make(map[string]*prefetchEntry),
+		size:    cfg.size,
+		minHits: cfg.minHits,
+	}
+}
+
+// Track counts the query hit and schedules the answer refresh
+func (p *prefetcher) Track(req, rsp *dns.Msg, clientIP net.IP) {
+	p.schedule(req, rsp, clientIP, 1)
+}
+
+// Reschedule schedules the next refresh of the prefetched answer w/o counting it as a hit
+func (p *prefetcher) Reschedule(req, rsp *dns.Msg, clientIP net.IP) {
+	p.schedule(req, rsp, clientIP, 0)
+}
+
+// Due returns the popular entries to be refreshed now, the others are forgotten
+func (p *prefetcher) Due(now time.Time) []*prefetchEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var out []*prefetchEntry
+	for key, entry := range p.entries {
+		if now.Before(entry.refreshAt) {
+			continue
+		}
+
+		delete(p.entries, key)
+		if entry.hits >= p.minHits {
+			out = append(out, entry)
+		}
+	}
+
+	return out
+}
+
+func (p *prefetcher) schedule(req, rsp *dns.Msg, clientIP net.IP, hits int) {
+	if rsp.Rcode != dns.RcodeSuccess || len(rsp.Answer) == 0 || rsp.Truncated {
+		return
+	}
+
+	ttl := time.Duration(minTTL(rsp.Answer)) * time.Second
+	if ttl < prefetchMinTTL {
+		return
+	}
+
+	key, ok := cacheKey(req)
+	if !ok {
+		return
+	}
+
+	refreshAt := time.Now().Add(time.Duration(float64(ttl) * prefetchTTLFraction))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[key]
+	if !ok {
+		if len(p.entries) >= p.size {
+			return
+		}
+
+		entry = &prefetchEntry{
+			req: req.Copy(),
+		}
+		p.entries[key] = entry
+	}
+
+	entry.hits += hits
+	entry.clientIP = clientIP
+	// TTL of the cached answers decreases, so keep the earliest refresh time
+	if entry.refreshAt.IsZero() || refreshAt.Before(entry.refreshAt) {
+		entry.refreshAt = refreshAt
+	}
+}
@@ -0,0 +1,126 @@
+package dnssrv
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+type clientSampleRate struct {
+	nets []*net.IPNet
+	rate float64
+}
+
+type queryLogEntry struct {
+	startedAt time.Time
+	clientIP  net.IP
+	req       *dns.Msg
+	rsp       *dns.Msg
+	upstream  string
+	handled   []handledRR
+}
+
+// queryLogger writes sampled queries as JSON lines
+type queryLogger struct {
+	out         *rotatingFile
+	log         zerolog.Logger
+	sampleRate  float64
+	clientRates []clientSampleRate
+}
+
+func newQueryLogger(cfg *QueryLogConfig) (*queryLogger, error) {
+	out, err := openRotatingFile(cfg.path, cfg.maxSize, cfg.rotatePeriod, cfg.maxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	return &queryLogger{
+		out:         out,
+		log:         zerolog.New(out).With().Timestamp().Logger(),
+		sampleRate:  cfg.sampleRate,
+		clientRates: cfg.clientRates,
+	}, nil
+}
+
+func (l *queryLogger) Log(entry queryLogEntry) {
+	if !l.sampled(entry.clientIP) {
+		return
+	}
+
+	var qname, qtype string
+	if len(entry.req.Question) > 0 {
+		qname = entry.req.Question[0].Name
+		qtype = dns.TypeToString[entry.req.Question[0].Qtype]
+	}
+
+	// nil response means that the query was dropped
+	rcode := "DROPPED"
+	var answers []string
+	if entry.rsp != nil {
+		rcode = dns.RcodeToString[entry.rsp.Rcode]
+		answers = make([]string, len(entry.rsp.Answer))
+		for i, rr := range entry.rsp.Answer {
+			answers[i] = fmt.Sprintf("%s %s",
+				dns.TypeToString[rr.Header().Rrtype],
+				strings.TrimPrefix(rr.String(), rr.Header().String()),
+			)
+		}
+	}
+
+	decisions := zerolog.Dict()
+	for _, h := range entry.handled {
+		if h.verdict.Decision != "" {
+			decisions.Str(h.rr.IP.String(), h.verdict.Decision)
+		}
+	}
+
+	l.log.Log().
+		Str("client_ip", entry.clientIP.String()).
+		Str("qname", qname).
+		Str("qtype", qtype).
+		Str("rcode", rcode).
+		Strs("answers", answers).
+		Str("upstream", entry.upstream).
+		Dur("latency_ms", time.Since(entry.startedAt)).
+		Dict("decisions", decisions).
+		Send()
+}
+
+func (l *queryLogger) Close() error {
+	return l.out.Close()
+}
+
+// sampled reports whether the query of the client should be logged, per-client rates take precedence over the default one
+func (l *queryLogger) sampled(clientIP net.IP) bool {
+	rate := l.sampleRate
+	for _, cr := range l.clientRates {
+		if containsIP(cr.nets, clientIP) {
+			rate = cr.rate
+			break
+		}
+	}
+
+	switch {
+	case rate >= 1:
+		return true
+	case rate <= 0:
+		return false
+	default:
+		return rand.Float64() < rate
+	}
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,85 @@
+package dnssrv
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/karlseguin/ccache/v3"
+)
+
+const (
+	// idle buckets are refilled anyway, so there is no reason to keep them for long
+	rateLimitBucketTTL = 1 * time.Minute
+)
+
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	updateAt time.Time
+}
+
+// rateLimiter is the per-client (or per-prefix) token bucket rate limiter
+type rateLimiter struct {
+	buckets    *ccache.Cache[*tokenBucket]
+	qps        float64
+	burst      float64
+	ipv4Prefix int
+	ipv6Prefix int
+	action     RateLimitAction
+}
+
+func newRateLimiter(cfg *RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		buckets: ccache.New(
+			ccache.Configure[*tokenBucket]().
+				MaxSize(cfg.size),
+		),
+		qps:        cfg.qps,
+		burst:      float64(cfg.burst),
+		ipv4Prefix: cfg.ipv4Prefix,
+		ipv6Prefix: cfg.ipv6Prefix,
+		action:     cfg.action,
+	}
+}
+
+// Allow takes a token from the client bucket and reports whether the query may be served
+func (l *rateLimiter) Allow(ip net.IP) bool {
+	item, _ := l.buckets.Fetch(l.clientKey(ip), rateLimitBucketTTL, func() (*tokenBucket, error) {
+		return &tokenBucket{
+			tokens:   l.burst,
+			updateAt: time.Now(),
+		}, nil
+	})
+	item.Extend(rateLimitBucketTTL)
+
+	bucket := item.Value()
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.updateAt).Seconds() * l.qps
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.updateAt = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
+
+func (l *rateLimiter) Stop() {
+	l.buckets.Stop()
+}
+
+func (l *rateLimiter) clientKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.ipv4Prefix, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(l.ipv6Prefix, 128)).String()
+}
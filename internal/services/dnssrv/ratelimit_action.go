@@ -0,0 +1,78 @@
+package dnssrv
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+var _ yaml.Unmarshaler = (*RateLimitAction)(nil)
+var _ yaml.Marshaler = (*RateLimitAction)(nil)
+var _ json.Unmarshaler = (*RateLimitAction)(nil)
+var _ json.Marshaler = (*RateLimitAction)(nil)
+
+type RateLimitAction uint8
+
+const (
+	RateLimitActionRefuse RateLimitAction = iota
+	RateLimitActionDrop
+	RateLimitActionTruncate
+)
+
+func (s RateLimitAction) String() string {
+	switch s {
+	case RateLimitActionRefuse:
+		return "refuse"
+	case RateLimitActionDrop:
+		return "drop"
+	case RateLimitActionTruncate:
+		return "truncate"
+	default:
+		return fmt.Sprintf("unknown_%d", uint8(s))
+	}
+}
+
+func (s *RateLimitAction) fromString(in string) error {
+	switch in {
+	case "", "refuse":
+		*s = RateLimitActionRefuse
+	case "drop":
+		*s = RateLimitActionDrop
+	case "truncate":
+		*s = RateLimitActionTruncate
+	default:
+		return fmt.Errorf("unknown rate limit action: %s", in)
+	}
+	return nil
+}
+
+func (s RateLimitAction) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+func (s *RateLimitAction) UnmarshalYAML(val *yaml.Node) error {
+	var in string
+	if err := val.Decode(&in); err != nil {
+		return err
+	}
+
+	return s.fromString(in)
+}
+
+func (s RateLimitAction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *RateLimitAction) UnmarshalJSON(in []byte) error {
+	var str string
+	if err := json.Unmarshal(in, &str); err != nil {
+		return err
+	}
+
+	return s.fromString(str)
+}
+
+func (s *RateLimitAction) UnmarshalText(in []byte) error {
+	return s.fromString(string(in))
+}
@@ -0,0 +1,101 @@
+package dnssrv
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	cases := []struct {
+		name    string
+		qps     float64
+		burst   int
+		queries int
+		// elapsed time before the last query
+		elapsed time.Duration
+		allowed int
+	}{
+		{
+			name:    "within burst",
+			qps:     1,
+			burst:   5,
+			queries: 5,
+			allowed: 5,
+		},
+		{
+			name:    "over burst",
+			qps:     1,
+			burst:   5,
+			queries: 8,
+			allowed: 5,
+		},
+		{
+			name:    "refill",
+			qps:     10,
+			burst:   2,
+			queries: 4,
+			elapsed: 150 * time.Millisecond,
+			allowed: 3,
+		},
+		{
+			name:    "refill is capped by burst",
+			qps:     100,
+			burst:   3,
+			queries: 10,
+			elapsed: time.Hour,
+			allowed: 4,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newRateLimiter(NewRateLimitConfig().WithQPS(tc.qps).WithBurst(tc.burst).Build())
+			defer l.Stop()
+
+			ip := net.ParseIP("192.0.2.1")
+			var allowed int
+			for i := 0; i < tc.queries; i++ {
+				if i == tc.queries-1 && tc.elapsed > 0 {
+					bucket := l.buckets.Get(l.clientKey(ip)).Value()
+					bucket.updateAt = bucket.updateAt.Add(-tc.elapsed)
+				}
+
+				if l.Allow(ip) {
+					allowed++
+				}
+			}
+
+			if allowed != tc.allowed {
+				t.Fatalf("allowed: got %d, want %d", allowed, tc.allowed)
+			}
+		})
+	}
+}
+
+func TestRateLimiterClientKey(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{name: "same IPv4 /24", a: "192.0.2.1", b: "192.0.2.200", same: true},
+		{name: "other IPv4 /24", a: "192.0.2.1", b: "192.0.3.1"},
+		{name: "same IPv6 /56", a: "2001:db8:0:1::1", b: "2001:db8:0:ff::2", same: true},
+		{name: "other IPv6 /56", a: "2001:db8:0:100::1", b: "2001:db8:0:200::1"},
+		{name: "IPv4-mapped IPv6", a: "::ffff:192.0.2.1", b: "192.0.2.5", same: true},
+	}
+
+	l := newRateLimiter(NewRateLimitConfig().WithQPS(1).WithPrefixes(24, 56).Build())
+	defer l.Stop()
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := l.clientKey(net.ParseIP(tc.a))
+			b := l.clientKey(net.ParseIP(tc.b))
+			if (a == b) != tc.same {
+				t.Fatalf("keys %q and %q: same must be %t", a, b, tc.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package dnssrv
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+var _ dns.ResponseWriter = (*bufferedResponseWriter)(nil)
+
+// bufferedResponseWriter keeps the handler's response, so the DoH/DoQ servers frame and write it on their own
+type bufferedResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	rsp        *dns.Msg
+}
+
+func (w *bufferedResponseWriter) LocalAddr() net.Addr {
+	return w.localAddr
+}
+
+func (w *bufferedResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *bufferedResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.rsp = msg
+	return nil
+}
+
+func (w *bufferedResponseWriter) Write(buf []byte) (int, error) {
+	var msg dns.Msg
+	if err := msg.Unpack(buf); err != nil {
+		return 0, err
+	}
+
+	w.rsp = &msg
+	return len(buf), nil
+}
+
+func (w *bufferedResponseWriter) Close() error {
+	return nil
+}
+
+func (w *bufferedResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *bufferedResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *bufferedResponseWriter) Hijack() {}
@@ -0,0 +1,139 @@
+package dnssrv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	rotatedSuffixLayout = "20060102T150405.000000"
+)
+
+// rotatingFile is the io.Writer that rotates the underlying file by size and age, keeping up to maxBackups rotated files
+type rotatingFile struct {
+	path         string
+	maxSize      int64
+	rotatePeriod time.Duration
+	maxBackups   int
+	mu           sync.Mutex
+	f            *os.File
+	size         int64
+	openedAt     time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, rotatePeriod time.Duration, maxBackups int) (*rotatingFile, error) {
+	out := &rotatingFile{
+		path:         path,
+		maxSize:      maxSize,
+		rotatePeriod: rotatePeriod,
+		maxBackups:   maxBackups,
+	}
+
+	if err := out.open(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.shouldRotate(len(p)) {
+		if err := r.rotate(); err != nil {
+			// postpone the next attempt, otherwise every write would retry it
+			r.openedAt = time.Now()
+			r.size = 0
+			log.Error().Err(err).Str("path", r.path).Msg("unable to rotate log file")
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.f.Close()
+}
+
+func (r *rotatingFile) shouldRotate(toWrite int) bool {
+	if r.size == 0 {
+		return false
+	}
+
+	if r.maxSize > 0 && r.size+int64(toWrite) > r.maxSize {
+		return true
+	}
+
+	return r.rotatePeriod > 0 && time.Since(r.openedAt) >= r.rotatePeriod
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("unable to create log dir: %w", err)
+	}
+
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("unable to open log file: %w", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to stat log file: %w", err)
+	}
+
+	r.f = f
+	r.size = fi.Size()
+	r.openedAt = time.Now()
+	return nil
+}
+
+// rotate renames the current file before closing it, so on failure the logging goes on to the current one
+func (r *rotatingFile) rotate() error {
+	rotated := fmt.Sprintf("%s.%s", r.path, time.Now().Format(rotatedSuffixLayout))
+	if err := os.Rename(r.path, rotated); err != nil {
+		return fmt.Errorf("unable to rotate log file: %w", err)
+	}
+
+	prev := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	if err := prev.Close(); err != nil {
+		log.Warn().Err(err).Str("path", rotated).Msg("unable to close rotated log file")
+	}
+
+	r.removeOldBackups()
+	return nil
+}
+
+func (r *rotatingFile) removeOldBackups() {
+	if r.maxBackups <= 0 {
+		return
+	}
+
+	backups, err := filepath.Glob(r.path + ".*")
+	if err != nil || len(backups) <= r.maxBackups {
+		return
+	}
+
+	// suffixes are timestamps, so lexical order is chronological
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-r.maxBackups] {
+		_ = os.Remove(backup)
+	}
+}
@@ -1,15 +1,63 @@
 package dnssrv
 
 import (
+	"context"
 	"net"
 )
 
 type RR struct {
 	FQDN string
-	Kind IPKind
-	IP   net.IP
-	TTL  uint32
+	// Chain is the CNAME chain from the FQDN to the name that owns the IP,
+	// e.g. [foo.example.com. foo.cdn-provider.net.]. Empty if the FQDN owns the IP itself.
+	Chain []string
+	Kind  IPKind
+	IP    net.IP
+	TTL   uint32
+}
+
+// Target returns the name that owns the IP: the last name of the CNAME chain or the FQDN itself
+func (r RR) Target() string {
+	if len(r.Chain) == 0 {
+		return r.FQDN
+	}
+
+	return r.Chain[len(r.Chain)-1]
+}
+
+// Verdict is the handler decision about the RR
+type Verdict struct {
+	// Routed reports whether the IP is routed by the handler
+	Routed bool
+	// MaxTTL limits TTL of the answer (e.g. by the remaining route lifetime), zero means no limit
+	MaxTTL uint32
+	// Decision is the human-readable handler decision, used for the query log only
+	Decision string
+}
+
+type handledRR struct {
+	rr      RR
+	verdict Verdict
+}
+
+// Routing is the handler view of how the name is routed
+type Routing struct {
+	// VPN reports whether the name is routed over VPN
+	VPN bool
+	// IPv6 reports whether IPv6 routes are exported, so IPv6 addresses of the name are reachable over VPN
+	IPv6 bool
 }
 
 type handleFilter func(RR, net.IP) bool
-type IPHandler func(RR)
+
+// IPHandler is called for every observable IP of the answer. The response is held while handlers are running,
+// so with the handle timeout configured a handler may block until the ctx is done to delay the response
+// (e.g. until the route is announced).
+type IPHandler func(ctx context.Context, rr RR) Verdict
+
+// RoutingLookup returns routing of the name, the CNAME chain (see RR.Chain) may be taken into account as well.
+// Called for every answer, so it must not block.
+type RoutingLookup func(fqdn string, chain []string) Routing
+
+// TamperHandler is called for the name whose upstream response failed DNSSEC validation, that's a sign of the on-path
+// tampering (e.g. injected answers). Must not block.
+type TamperHandler func(fqdn string)
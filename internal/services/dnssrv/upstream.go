@@ -0,0 +1,158 @@
+package dnssrv
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/buglloc/certifi"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+
+	"github.com/buglloc/deblocker/internal/netutil"
+)
+
+const (
+	upstreamIdleTimeout = 30 * time.Second
+	// how long to speak plain DNS with the upstream that doesn't support EDNS0
+	upstreamNoEDNSPeriod = 10 * time.Minute
+)
+
+// errNoEDNS is returned for the DNSSEC requests to the upstream w/o EDNS0: the answer can't be validated,
+// but it isn't the proof of tampering either
+var errNoEDNS = errors.New("upstream doesn't support EDNS0")
+
+type Upstream interface {
+	Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+	Addr() string
+}
+
+type upstreamTraceKey struct{}
+
+// upstreamTrace records the address of the upstream that actually answered the request
+type upstreamTrace struct {
+	addr string
+}
+
+func withUpstreamTrace(ctx context.Context) (context.Context, *upstreamTrace) {
+	trace := &upstreamTrace{}
+	return context.WithValue(ctx, upstreamTraceKey{}, trace), trace
+}
+
+func traceUpstream(ctx context.Context, addr string) {
+	if trace, ok := ctx.Value(upstreamTraceKey{}).(*upstreamTrace); ok {
+		trace.addr = addr
+	}
+}
+
+type upstreamOpts struct {
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	control      netutil.ControlFn
+}
+
+func newUpstream(addr *url.URL, opts upstreamOpts) (Upstream, error) {
+	tlsCfg := &tls.Config{
+		RootCAs:    certifi.NewCertPool(),
+		ServerName: addr.Hostname(),
+	}
+
+	switch addr.Scheme {
+	case "udp", "tcp":
+		return newPlainUpstream(addr.Scheme, hostWithDefaultPort(addr, "53"), nil, opts), nil
+	case "tcp-tls", "tls":
+		return newPlainUpstream("tcp-tls", hostWithDefaultPort(addr, "853"), tlsCfg, opts), nil
+	case "https":
+		return newDoHUpstream(addr, tlsCfg, opts), nil
+	case "quic":
+		return newDoQUpstream(hostWithDefaultPort(addr, "853"), tlsCfg, opts), nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme: %s", addr.Scheme)
+	}
+}
+
+type plainUpstream struct {
+	addr string
+	dnsc *dns.Client
+	// tcpc is used to retry truncated UDP responses
+	tcpc *dns.Client
+	// noEDNSUntil is the unix nano time until which the upstream is known to not support EDNS0
+	noEDNSUntil atomic.Int64
+}
+
+func newPlainUpstream(network, addr string, tlsCfg *tls.Config, opts upstreamOpts) *plainUpstream {
+	newClient := func(network string) *dns.Client {
+		return &dns.Client{
+			Net:       network,
+			TLSConfig: tlsCfg,
+			Dialer: &net.Dialer{
+				Timeout: opts.dialTimeout,
+				Control: opts.control,
+			},
+			ReadTimeout:  opts.readTimeout,
+			WriteTimeout: opts.writeTimeout,
+		}
+	}
+
+	out := &plainUpstream{
+		addr: addr,
+		dnsc: newClient(network),
+	}
+
+	if network == "udp" {
+		out.tcpc = newClient("tcp")
+	}
+
+	return out
+}
+
+// Exchange falls back to plain DNS for the upstreams w/o EDNS0 support, except for the requests with the DO bit:
+// stripping it would strip the DNSSEC records as well, so errNoEDNS is returned instead
+func (u *plainUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	opt := req.IsEdns0()
+	if opt != nil && time.Now().UnixNano() < u.noEDNSUntil.Load() {
+		if opt.Do() {
+			return nil, errNoEDNS
+		}
+
+		return u.exchange(ctx, withoutEDNS(req))
+	}
+
+	rsp, err := u.exchange(ctx, req)
+	if err != nil || !isEDNSUnsupported(req, rsp) {
+		return rsp, err
+	}
+
+	// RFC 6891, section 7: the responder doesn't support EDNS0, retry w/o OPT and remember that
+	u.noEDNSUntil.Store(time.Now().Add(upstreamNoEDNSPeriod).UnixNano())
+	log.Debug().
+		Str("upstream", u.Addr()).
+		Str("rcode", dns.RcodeToString[rsp.Rcode]).
+		Msg("upstream doesn't support EDNS0, fallback to plain DNS")
+
+	if opt.Do() {
+		return nil, errNoEDNS
+	}
+
+	return u.exchange(ctx, withoutEDNS(req))
+}
+
+func (u *plainUpstream) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	rsp, _, err := u.dnsc.ExchangeContext(ctx, req, u.addr)
+	if err != nil || !rsp.Truncated || u.tcpc == nil {
+		return rsp, err
+	}
+
+	rsp, _, err = u.tcpc.ExchangeContext(ctx, req, u.addr)
+	return rsp, err
+}
+
+func (u *plainUpstream) Addr() string {
+	return u.dnsc.Net + "://" + u.addr
+}
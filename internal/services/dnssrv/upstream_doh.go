@@ -0,0 +1,92 @@
+package dnssrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/miekg/dns"
+)
+
+type dohUpstream struct {
+	uri   string
+	httpc *http.Client
+}
+
+func newDoHUpstream(addr *url.URL, tlsCfg *tls.Config, opts upstreamOpts) *dohUpstream {
+	uri := *addr
+	if uri.Path == "" {
+		uri.Path = DefaultDoHPath
+	}
+
+	dialer := &net.Dialer{
+		Timeout: opts.dialTimeout,
+		Control: opts.control,
+	}
+
+	return &dohUpstream{
+		uri: uri.String(),
+		httpc: &http.Client{
+			Transport: &http.Transport{
+				DialContext:           dialer.DialContext,
+				TLSClientConfig:       tlsCfg,
+				TLSHandshakeTimeout:   opts.dialTimeout,
+				ResponseHeaderTimeout: opts.readTimeout,
+				ForceAttemptHTTP2:     true,
+				MaxIdleConns:          8,
+				IdleConnTimeout:       upstreamIdleTimeout,
+			},
+			Timeout: opts.dialTimeout + opts.writeTimeout + opts.readTimeout,
+		},
+	}
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484, section 4.1: use a DNS ID of 0 in every request to be cache friendly
+	msg := req.Copy()
+	msg.Id = 0
+
+	buf, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("unable to pack request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.uri, bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create HTTP request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", dohContentType)
+	httpReq.Header.Set("Accept", dohContentType)
+
+	httpRsp, err := u.httpc.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("unable to make HTTP request: %w", err)
+	}
+	defer func() { _ = httpRsp.Body.Close() }()
+
+	if httpRsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %s", httpRsp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpRsp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response: %w", err)
+	}
+
+	var rsp dns.Msg
+	if err := rsp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("unable to parse response: %w", err)
+	}
+
+	rsp.Id = req.Id
+	return &rsp, nil
+}
+
+func (u *dohUpstream) Addr() string {
+	return u.uri
+}
@@ -0,0 +1,221 @@
+package dnssrv
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	doqALPN = "doq"
+	// RFC 9250, section 4.3: DOQ_NO_ERROR
+	doqNoError = 0x0
+)
+
+type doqUpstream struct {
+	addr    string
+	tlsCfg  *tls.Config
+	quicCfg *quic.Config
+	opts    upstreamOpts
+	mu      sync.Mutex
+	tr      *quic.Transport
+	conn    quic.Connection
+}
+
+func newDoQUpstream(addr string, tlsCfg *tls.Config, opts upstreamOpts) *doqUpstream {
+	tlsCfg = tlsCfg.Clone()
+	tlsCfg.NextProtos = []string{doqALPN}
+	opts.readTimeout = doqTimeout(opts.readTimeout)
+	opts.writeTimeout = doqTimeout(opts.writeTimeout)
+
+	return &doqUpstream{
+		addr:   addr,
+		tlsCfg: tlsCfg,
+		quicCfg: &quic.Config{
+			HandshakeIdleTimeout: opts.dialTimeout,
+			MaxIdleTimeout:       upstreamIdleTimeout,
+		},
+		opts: opts,
+	}
+}
+
+func (u *doqUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	conn, err := u.getConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect: %w", err)
+	}
+
+	rsp, err := u.exchange(ctx, conn, req)
+	if err == nil || ctx.Err() != nil || !isDoQConnClosed(conn, err) {
+		return rsp, err
+	}
+
+	// the cached connection may be silently closed by the server, so retry once with the new one.
+	// Other errors are the stream ones, the connection is shared with the concurrent queries and must be kept
+	u.resetConn(conn)
+	conn, err = u.getConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect: %w", err)
+	}
+
+	return u.exchange(ctx, conn, req)
+}
+
+func (u *doqUpstream) exchange(ctx context.Context, conn quic.Connection, req *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open stream: %w", err)
+	}
+	defer stream.CancelRead(doqNoError)
+
+	// RFC 9250, section 4.2.1: the DNS Message ID MUST be set to 0
+	msg := req.Copy()
+	msg.Id = 0
+
+	buf, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("unable to pack request: %w", err)
+	}
+
+	_ = stream.SetWriteDeadline(time.Now().Add(u.opts.writeTimeout))
+	if _, err := stream.Write(doqFrame(buf)); err != nil {
+		return nil, fmt.Errorf("unable to write request: %w", err)
+	}
+
+	// the client MUST indicate that no further data will be sent on the stream
+	_ = stream.Close()
+
+	_ = stream.SetReadDeadline(time.Now().Add(u.opts.readTimeout))
+	rsp, err := doqReadMsg(stream)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response: %w", err)
+	}
+
+	rsp.Id = req.Id
+	return rsp, nil
+}
+
+func (u *doqUpstream) Addr() string {
+	return "quic://" + u.addr
+}
+
+func (u *doqUpstream) getConn(ctx context.Context) (quic.Connection, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn != nil && u.conn.Context().Err() == nil {
+		return u.conn, nil
+	}
+
+	u.lockedClose()
+
+	dialCtx, cancel := context.WithTimeout(ctx, u.opts.dialTimeout)
+	defer cancel()
+
+	raddr, err := net.ResolveUDPAddr("udp", u.addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve addr: %w", err)
+	}
+
+	lc := net.ListenConfig{
+		Control: u.opts.control,
+	}
+	pc, err := lc.ListenPacket(dialCtx, "udp", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create UDP socket: %w", err)
+	}
+
+	tr := &quic.Transport{
+		Conn: pc,
+	}
+	conn, err := tr.Dial(dialCtx, raddr, u.tlsCfg, u.quicCfg)
+	if err != nil {
+		_ = tr.Close()
+		_ = pc.Close()
+		return nil, err
+	}
+
+	u.tr = tr
+	u.conn = conn
+	return conn, nil
+}
+
+// resetConn closes the dead connection unless it was already replaced by the concurrent query
+func (u *doqUpstream) resetConn(conn quic.Connection) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn == conn {
+		u.lockedClose()
+	}
+}
+
+func (u *doqUpstream) lockedClose() {
+	if u.conn != nil {
+		_ = u.conn.CloseWithError(doqNoError, "")
+		u.conn = nil
+	}
+
+	if u.tr != nil {
+		_ = u.tr.Close()
+		_ = u.tr.Conn.Close()
+		u.tr = nil
+	}
+}
+
+// isDoQConnClosed reports whether the query failed because the whole connection is gone
+func isDoQConnClosed(conn quic.Connection, err error) bool {
+	if conn.Context().Err() != nil {
+		return true
+	}
+
+	var idleErr *quic.IdleTimeoutError
+	var appErr *quic.ApplicationError
+	var resetErr *quic.StatelessResetError
+	return errors.As(err, &idleErr) || errors.As(err, &appErr) || errors.As(err, &resetErr)
+}
+
+func doqFrame(buf []byte) []byte {
+	out := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(out, uint16(len(buf)))
+	copy(out[2:], buf)
+	return out
+}
+
+func doqReadMsg(r io.Reader) (*dns.Msg, error) {
+	var sizeBuf [2]byte
+	if _, err := io.ReadFull(r, sizeBuf[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(sizeBuf[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	var msg dns.Msg
+	if err := msg.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("unable to parse DNS message: %w", err)
+	}
+
+	return &msg, nil
+}
+
+// doqTimeout applies the default to the zero timeout, like the dns package does for the other transports:
+// the stream deadline is set right away, so zero would make it already expired
+func doqTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DefaultTimeout
+	}
+
+	return timeout
+}
@@ -0,0 +1,194 @@
+package dnssrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	upstreamMinBackoff = 1 * time.Second
+	upstreamMaxBackoff = 1 * time.Minute
+)
+
+var _ Upstream = (*upstreamPool)(nil)
+
+type upstreamState struct {
+	Upstream
+	mu           sync.Mutex
+	fails        int
+	backoffUntil time.Time
+}
+
+func (s *upstreamState) isHealthy(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return now.After(s.backoffUntil)
+}
+
+func (s *upstreamState) onSuccess() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fails > 0 {
+		log.Info().
+			Str("upstream", s.Addr()).
+			Msg("upstream is alive again")
+	}
+
+	s.fails = 0
+	s.backoffUntil = time.Time{}
+}
+
+func (s *upstreamState) onFailure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backoff := upstreamMaxBackoff
+	if s.fails < 16 {
+		backoff = upstreamMinBackoff << s.fails
+		if backoff > upstreamMaxBackoff {
+			backoff = upstreamMaxBackoff
+		}
+	}
+
+	s.fails++
+	s.backoffUntil = time.Now().Add(backoff)
+	log.Warn().
+		Str("upstream", s.Addr()).
+		Int("fails", s.fails).
+		Dur("backoff", backoff).
+		Msg("upstream marked as unhealthy")
+}
+
+type upstreamPool struct {
+	strategy  UpstreamStrategy
+	upstreams []*upstreamState
+	next      atomic.Uint32
+}
+
+func newUpstreamPool(strategy UpstreamStrategy, upstreams ...Upstream) *upstreamPool {
+	out := &upstreamPool{
+		strategy:  strategy,
+		upstreams: make([]*upstreamState, len(upstreams)),
+	}
+
+	for i, u := range upstreams {
+		out.upstreams[i] = &upstreamState{
+			Upstream: u,
+		}
+	}
+
+	return out
+}
+
+func (p *upstreamPool) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	candidates := p.candidates()
+	if p.strategy == UpstreamStrategyRace && len(candidates) > 1 {
+		return p.race(ctx, req, candidates)
+	}
+
+	var errs error
+	for _, u := range candidates {
+		rsp, err := u.Exchange(ctx, req)
+		if err == nil {
+			u.onSuccess()
+			traceUpstream(ctx, u.Addr())
+			return rsp, nil
+		}
+
+		u.onFailure()
+		errs = multierror.Append(errs, fmt.Errorf("%s: %w", u.Addr(), err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errs
+}
+
+func (p *upstreamPool) Addr() string {
+	addrs := make([]string, len(p.upstreams))
+	for i, u := range p.upstreams {
+		addrs[i] = u.Addr()
+	}
+
+	return strings.Join(addrs, ",")
+}
+
+func (p *upstreamPool) race(ctx context.Context, req *dns.Msg, candidates []*upstreamState) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		addr string
+		rsp  *dns.Msg
+		err  error
+	}
+
+	results := make(chan result, len(candidates))
+	for _, u := range candidates {
+		go func(u *upstreamState, req *dns.Msg) {
+			rsp, err := u.Exchange(ctx, req)
+			switch {
+			case err == nil:
+				u.onSuccess()
+			case errors.Is(ctx.Err(), context.Canceled):
+				// losing the race doesn't mean that upstream is dead
+			default:
+				u.onFailure()
+				err = fmt.Errorf("%s: %w", u.Addr(), err)
+			}
+
+			results <- result{addr: u.Addr(), rsp: rsp, err: err}
+		}(u, req.Copy())
+	}
+
+	var errs error
+	for range candidates {
+		res := <-results
+		if res.err == nil {
+			traceUpstream(ctx, res.addr)
+			return res.rsp, nil
+		}
+
+		errs = multierror.Append(errs, res.err)
+	}
+
+	return nil, errs
+}
+
+// candidates returns healthy upstreams in the order of the strategy.
+// If there are no healthy upstreams, all of them are returned to have a chance to recover.
+func (p *upstreamPool) candidates() []*upstreamState {
+	ordered := p.upstreams
+	if p.strategy == UpstreamStrategyRoundRobin && len(p.upstreams) > 1 {
+		start := int(p.next.Add(1)-1) % len(p.upstreams)
+		ordered = make([]*upstreamState, 0, len(p.upstreams))
+		ordered = append(ordered, p.upstreams[start:]...)
+		ordered = append(ordered, p.upstreams[:start]...)
+	}
+
+	now := time.Now()
+	out := make([]*upstreamState, 0, len(ordered))
+	for _, u := range ordered {
+		if u.isHealthy(now) {
+			out = append(out, u)
+		}
+	}
+
+	if len(out) == 0 {
+		return ordered
+	}
+
+	return out
+}
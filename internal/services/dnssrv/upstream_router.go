@@ -0,0 +1,48 @@
+package dnssrv
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+
+	"github.com/buglloc/deblocker/internal/domains"
+)
+
+var _ Upstream = (*upstreamRouter)(nil)
+
+type upstreamRoute struct {
+	domains  []string
+	upstream Upstream
+}
+
+// upstreamRouter forwards requests to the upstream of the most specific matching route
+type upstreamRouter struct {
+	routes   []upstreamRoute
+	fallback Upstream
+}
+
+func (r *upstreamRouter) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return r.upstreamFor(req).Exchange(ctx, req)
+}
+
+func (r *upstreamRouter) Addr() string {
+	return r.fallback.Addr()
+}
+
+func (r *upstreamRouter) upstreamFor(req *dns.Msg) Upstream {
+	if len(req.Question) == 0 {
+		return r.fallback
+	}
+
+	qname := req.Question[0].Name
+	out := r.fallback
+	bestLen := -1
+	for _, route := range r.routes {
+		if l := domains.Match(route.domains, qname); l > bestLen {
+			bestLen = l
+			out = route.upstream
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,78 @@
+package dnssrv
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+var _ yaml.Unmarshaler = (*UpstreamStrategy)(nil)
+var _ yaml.Marshaler = (*UpstreamStrategy)(nil)
+var _ json.Unmarshaler = (*UpstreamStrategy)(nil)
+var _ json.Marshaler = (*UpstreamStrategy)(nil)
+
+type UpstreamStrategy uint8
+
+const (
+	UpstreamStrategyFailover UpstreamStrategy = iota
+	UpstreamStrategyRace
+	UpstreamStrategyRoundRobin
+)
+
+func (s UpstreamStrategy) String() string {
+	switch s {
+	case UpstreamStrategyFailover:
+		return "failover"
+	case UpstreamStrategyRace:
+		return "race"
+	case UpstreamStrategyRoundRobin:
+		return "round_robin"
+	default:
+		return fmt.Sprintf("unknown_%d", uint8(s))
+	}
+}
+
+func (s *UpstreamStrategy) fromString(in string) error {
+	switch in {
+	case "", "failover":
+		*s = UpstreamStrategyFailover
+	case "race":
+		*s = UpstreamStrategyRace
+	case "round_robin":
+		*s = UpstreamStrategyRoundRobin
+	default:
+		return fmt.Errorf("unknown upstream strategy: %s", in)
+	}
+	return nil
+}
+
+func (s UpstreamStrategy) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+func (s *UpstreamStrategy) UnmarshalYAML(val *yaml.Node) error {
+	var in string
+	if err := val.Decode(&in); err != nil {
+		return err
+	}
+
+	return s.fromString(in)
+}
+
+func (s UpstreamStrategy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *UpstreamStrategy) UnmarshalJSON(in []byte) error {
+	var str string
+	if err := json.Unmarshal(in, &str); err != nil {
+		return err
+	}
+
+	return s.fromString(str)
+}
+
+func (s *UpstreamStrategy) UnmarshalText(in []byte) error {
+	return s.fromString(string(in))
+}
@@ -0,0 +1,135 @@
+package dnssrv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPlainUpstreamEDNSFallback(t *testing.T) {
+	cases := []struct {
+		name     string
+		rcode    int
+		withOPT  bool
+		queries  int32
+		wantEDNS bool
+	}{
+		{name: "FORMERR w/o OPT", rcode: dns.RcodeFormatError, queries: 2},
+		{name: "NOTIMP w/o OPT", rcode: dns.RcodeNotImplemented, queries: 2},
+		{name: "BADVERS", rcode: dns.RcodeBadVers, withOPT: true, queries: 2},
+		{name: "FORMERR with OPT", rcode: dns.RcodeFormatError, withOPT: true, queries: 1, wantEDNS: true},
+		{name: "SERVFAIL w/o OPT", rcode: dns.RcodeServerFailure, queries: 1, wantEDNS: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var queries atomic.Int32
+			addr := startTestDNSServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+				queries.Add(1)
+				rsp := new(dns.Msg)
+				rsp.SetReply(r)
+				if r.IsEdns0() != nil {
+					rsp.Rcode = tc.rcode
+					if tc.withOPT {
+						rsp.SetEdns0(DefaultEDNSBufSize, false)
+						rsp.IsEdns0().SetExtendedRcode(uint16(tc.rcode))
+					}
+				}
+				_ = w.WriteMsg(rsp)
+			}))
+
+			u := newPlainUpstream("udp", addr, nil, upstreamOpts{
+				dialTimeout:  time.Second,
+				readTimeout:  time.Second,
+				writeTimeout: time.Second,
+			})
+
+			req := newTestReq("example.com.", dns.TypeA)
+			if _, err := u.Exchange(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := queries.Load(); got != tc.queries {
+				t.Fatalf("queries: got %d, want %d", got, tc.queries)
+			}
+
+			// the next query must remember the EDNS0 support
+			queries.Store(0)
+			if _, err := u.Exchange(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+
+			wantQueries := int32(1)
+			if got := queries.Load(); got != wantQueries {
+				t.Fatalf("queries after fallback: got %d, want %d", got, wantQueries)
+			}
+
+			if req.IsEdns0() == nil {
+				t.Fatal("original request must not be modified")
+			}
+		})
+	}
+}
+
+func TestPlainUpstreamEDNSFallbackKeepsDO(t *testing.T) {
+	var plainQueries atomic.Int32
+	addr := startTestDNSServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		rsp := new(dns.Msg)
+		rsp.SetReply(r)
+		if r.IsEdns0() != nil {
+			rsp.Rcode = dns.RcodeFormatError
+		} else {
+			plainQueries.Add(1)
+		}
+		_ = w.WriteMsg(rsp)
+	}))
+
+	u := newPlainUpstream("udp", addr, nil, upstreamOpts{
+		dialTimeout:  time.Second,
+		readTimeout:  time.Second,
+		writeTimeout: time.Second,
+	})
+
+	doReq := newTestReq("example.com.", dns.TypeA)
+	doReq.IsEdns0().SetDo()
+	if _, err := u.Exchange(context.Background(), doReq); !errors.Is(err, errNoEDNS) {
+		t.Fatalf("DO request: got %v, want %v", err, errNoEDNS)
+	}
+
+	// the fallback is remembered for the plain requests, but not for the DNSSEC ones
+	if _, err := u.Exchange(context.Background(), newTestReq("example.com.", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := u.Exchange(context.Background(), doReq); !errors.Is(err, errNoEDNS) {
+		t.Fatalf("DO request after fallback: got %v, want %v", err, errNoEDNS)
+	}
+
+	if got := plainQueries.Load(); got != 1 {
+		t.Fatalf("queries w/o OPT: got %d, want 1", got)
+	}
+}
+
+func startTestDNSServer(t *testing.T, handler dns.Handler) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn:        pc,
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	<-started
+	return pc.LocalAddr().String()
+}